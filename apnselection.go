@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+var errEcmTimeout = errors.New("ECM initiation timeout")
+
+// buildApnLadder orders the APNs we are allowed to try for a SIM. The APN that last
+// worked for this ICCID goes first, then the configured APN, then the rest of the
+// acceptable APNs in a stable order so retries are predictable across restarts.
+func buildApnLadder(preferredApn string, acceptableApns map[string]struct{}, lastWorkingApn string) []string {
+	ladder := []string{}
+	seen := map[string]bool{}
+
+	add := func(apn string) {
+		if apn == "" || seen[apn] {
+			return
+		}
+		seen[apn] = true
+		ladder = append(ladder, apn)
+	}
+
+	if _, ok := acceptableApns[lastWorkingApn]; ok || lastWorkingApn == preferredApn {
+		add(lastWorkingApn)
+	}
+
+	add(preferredApn)
+
+	others := make([]string, 0, len(acceptableApns))
+	for apn := range acceptableApns {
+		others = append(others, apn)
+	}
+	sort.Strings(others)
+
+	for _, apn := range others {
+		add(apn)
+	}
+
+	return ladder
+}
+
+func iccidKey(iccid string) string {
+	iccid = strings.TrimSpace(iccid)
+	iccid = strings.TrimPrefix(iccid, "+ICCID:")
+	iccid = strings.TrimSuffix(iccid, "OK")
+	return strings.TrimSpace(iccid)
+}
+
+func sameLadder(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// RefreshApnLadder rebuilds the ladder on every modem configuration. The position on it is
+// only reset when the ladder changed, a modem reset in the middle of walking it would
+// otherwise start over from the top and never reach the APNs further down.
+func (m *Modem) RefreshApnLadder() {
+	ladder := buildApnLadder(Config.APN, Config.AcceptableAPNs, state.LastWorkingAPN[iccidKey(m.ICCID)])
+	if sameLadder(ladder, m.ApnLadder) {
+		return
+	}
+
+	m.ApnLadder = ladder
+	m.ApnIndex = 0
+	zap.S().Infof("apn ladder for this SIM: %v", m.ApnLadder)
+}
+
+func (m *Modem) CurrentApn() string {
+	if len(m.ApnLadder) == 0 {
+		return Config.APN
+	}
+
+	return m.ApnLadder[m.ApnIndex%len(m.ApnLadder)]
+}
+
+// NextApn moves down the ladder and writes the new APN to the modem so that the next
+// ECM attempt uses it. Once the ladder is exhausted it wraps around to the top.
+func (m *Modem) NextApn() error {
+	if len(m.ApnLadder) < 2 {
+		return nil
+	}
+
+	previousApn := m.CurrentApn()
+	m.ApnIndex = (m.ApnIndex + 1) % len(m.ApnLadder)
+	zap.S().Infof("apn %s didn't get a data session, trying %s", previousApn, m.CurrentApn())
+
+	return m.ConfigureApn()
+}
+
+// RecordWorkingApn remembers the APN that brought ECM up so the next start with the
+// same SIM tries it first.
+func (m *Modem) RecordWorkingApn() {
+	apn := m.CurrentApn()
+	m.MonitoringProperties.ActiveAPN = apn
+
+	key := iccidKey(m.ICCID)
+	if key == "" {
+		return
+	}
+
+	if state.LastWorkingAPN == nil {
+		state.LastWorkingAPN = map[string]string{}
+	}
+
+	if state.LastWorkingAPN[key] == apn {
+		return
+	}
+
+	state.LastWorkingAPN[key] = apn
+	if err := saveState(&state); err != nil {
+		zap.S().Errorf("unable to save working apn, error: %v", err)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	quectelCellLockQuery  = "AT+QNWLOCK=\"common/4g\""
+	quectelCellLockPrefix = "+QNWLOCK: \"common/4g\","
+	quectelServingCell    = "AT+QENG=\"servingcell\""
+)
+
+type CellLockStatus struct {
+	Locked bool
+	EARFCN int
+	PCI    int
+	// The LTE cell the modem is on, 0 when it isn't on one
+	ServingEARFCN int
+	ServingPCI    int
+	LostSince     time.Time
+	// The lock was let go of because the cell was gone for CellLostTimeout
+	Released bool
+	// A cell is configured but the modem's vendor has no cell lock here
+	Unsupported bool
+}
+
+// servingLteCell reads the EARFCN and PCI out of
+// +QENG: "servingcell",<state>,"LTE",<is_tdd>,<mcc>,<mnc>,<cellid>,<pci>,<earfcn>,...
+func servingLteCell(output string) (int, int, bool) {
+	values, found := modemSettingValues(output, "+QENG: \"servingcell\",")
+	if !found || len(values) < 8 || values[1] != "LTE" {
+		return 0, 0, false
+	}
+
+	if values[0] == "SEARCH" || values[0] == "LIMSRV" {
+		return 0, 0, false
+	}
+
+	pci, err := strconv.Atoi(values[6])
+	if err != nil {
+		return 0, 0, false
+	}
+	earfcn, err := strconv.Atoi(values[7])
+	if err != nil {
+		return 0, 0, false
+	}
+
+	return earfcn, pci, true
+}
+
+// CellLock keeps the modem on one LTE cell for fixed installations that would otherwise
+// ping-pong between two. A lock to a cell that went away would keep the modem off the network,
+// so once it has been gone for CellLostTimeout the lock is released until the configured cell
+// changes or the daemon restarts. The lock is only implemented for Quectel with AT+QNWLOCK,
+// on other modems the configured cell is rejected and reported as unsupported.
+type CellLock struct {
+	released NetworkLockConfig
+	status   CellLockStatus
+	// The configuration last rejected as unsupported, so it is logged once
+	unsupported *NetworkLockConfig
+}
+
+var cellLock CellLock
+
+func (c *CellLock) Status() CellLockStatus {
+	return c.status
+}
+
+func (c *CellLock) isReleased(networkLock NetworkLockConfig) bool {
+	return c.status.Released && c.released.EARFCN == networkLock.EARFCN && c.released.PCI == networkLock.PCI
+}
+
+// supported rejects a cell lock on modems it isn't implemented for before anything is sent
+// to them
+func (c *CellLock) supported(m *Modem, networkLock NetworkLockConfig) bool {
+	c.status.Unsupported = false
+	if m.Vendor == "Quectel" {
+		return true
+	}
+
+	if networkLock.EARFCN != 0 {
+		c.status.Unsupported = true
+		if c.unsupported == nil || *c.unsupported != networkLock {
+			zap.S().Errorf("cell lock to EARFCN %d PCI %d rejected, it is only supported on Quectel modems, not on %s %s",
+				networkLock.EARFCN, networkLock.PCI, m.Vendor, m.Model)
+			c.unsupported = &networkLock
+		}
+	}
+	return false
+}
+
+// Apply locks or unlocks the cell as configured, reading the current lock first
+func (c *CellLock) Apply(m *Modem) error {
+	networkLock := Config.NetworkLock
+	if !c.supported(m, networkLock) {
+		return nil
+	}
+
+	if c.status.Released && !c.isReleased(networkLock) {
+		c.status.Released = false
+	}
+	locked := networkLock.EARFCN != 0 && !c.status.Released
+
+	if !locked {
+		err := ensureModemSetting("cell lock", quectelCellLockQuery, quectelCellLockPrefix, []string{"0"},
+			quectelCellLockQuery+",0")
+		if err != nil {
+			return err
+		}
+		c.status.Locked = false
+		return nil
+	}
+
+	err := ensureModemSetting("cell lock", quectelCellLockQuery, quectelCellLockPrefix,
+		[]string{"1", strconv.Itoa(networkLock.EARFCN), strconv.Itoa(networkLock.PCI)},
+		fmt.Sprintf("%s,1,%d,%d", quectelCellLockQuery, networkLock.EARFCN, networkLock.PCI))
+	if err != nil {
+		return err
+	}
+
+	c.status.Locked = true
+	c.status.EARFCN = networkLock.EARFCN
+	c.status.PCI = networkLock.PCI
+	c.status.LostSince = time.Time{}
+	return nil
+}
+
+// Check follows the serving cell while locked and releases the lock once the locked cell has
+// been gone for longer than CellLostTimeout
+func (c *CellLock) Check(m *Modem) {
+	if !c.supported(m, Config.NetworkLock) || !c.status.Locked {
+		return
+	}
+
+	output, err := RunModemManagerCommand(quectelServingCell)
+	if err != nil {
+		zap.S().Errorf("unable to read serving cell, error: %v", err)
+		return
+	}
+
+	earfcn, pci, found := servingLteCell(output)
+	c.status.ServingEARFCN = earfcn
+	c.status.ServingPCI = pci
+
+	if found && earfcn == c.status.EARFCN && pci == c.status.PCI {
+		c.status.LostSince = time.Time{}
+		return
+	}
+
+	if c.status.LostSince.IsZero() {
+		zap.S().Warnf("locked cell %d/%d is gone", c.status.EARFCN, c.status.PCI)
+		c.status.LostSince = time.Now()
+		return
+	}
+
+	if time.Since(c.status.LostSince) < time.Duration(Config.NetworkLock.CellLostTimeout)*time.Second {
+		return
+	}
+
+	zap.S().Warnf("locked cell %d/%d gone since %s, releasing the cell lock",
+		c.status.EARFCN, c.status.PCI, c.status.LostSince)
+	c.released = Config.NetworkLock
+	c.status.Released = true
+
+	err = c.Apply(m)
+	if err != nil {
+		zap.S().Errorf("unable to release cell lock, error: %v", err)
+		c.status.Released = false
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import "testing"
+
+func TestCellLockUnsupported(t *testing.T) {
+	saved := Config
+	defer func() { Config = saved }()
+
+	tests := []struct {
+		vendor      string
+		earfcn      int
+		supported   bool
+		unsupported bool
+	}{
+		{"Quectel", 1300, true, false},
+		{"Quectel", 0, true, false},
+		{"Telit", 1300, false, true},
+		{"Telit", 0, false, false},
+	}
+
+	for _, test := range tests {
+		Config.NetworkLock = NetworkLockConfig{EARFCN: test.earfcn, PCI: 42}
+		lock := CellLock{}
+		modem := &Modem{Vendor: test.vendor, Model: "LE910C4-EU"}
+
+		if supported := lock.supported(modem, Config.NetworkLock); supported != test.supported {
+			t.Errorf("%s with EARFCN %d supported = %t, want %t", test.vendor, test.earfcn, supported, test.supported)
+		}
+		if status := lock.Status(); status.Unsupported != test.unsupported || status.Locked {
+			t.Errorf("%s with EARFCN %d reports %+v, want unsupported %t", test.vendor, test.earfcn, status, test.unsupported)
+		}
+	}
+}
+
+func TestServingLteCell(t *testing.T) {
+	tests := []struct {
+		output string
+		earfcn int
+		pci    int
+		found  bool
+	}{
+		{"+QENG: \"servingcell\",\"NOCONN\",\"LTE\",\"FDD\",262,01,1A2D00B,42,1300,3,5,5,9C40,-95,-11,-64,14,31\r\nOK", 1300, 42, true},
+		{"+QENG: \"servingcell\",\"SEARCH\",\"LTE\",\"FDD\",262,01,1A2D00B,42,1300", 0, 0, false},
+		{"+QENG: \"servingcell\",\"NOCONN\",\"WCDMA\",262,01,1A2D,00B,10700,42", 0, 0, false},
+		{"ERROR", 0, 0, false},
+	}
+
+	for _, test := range tests {
+		earfcn, pci, found := servingLteCell(test.output)
+		if earfcn != test.earfcn || pci != test.pci || found != test.found {
+			t.Errorf("servingLteCell(%q) = %d, %d, %t, want %d, %d, %t",
+				test.output, earfcn, pci, found, test.earfcn, test.pci, test.found)
+		}
+	}
+}
@@ -5,12 +5,158 @@ import (
 	"path/filepath"
 	"reflect"
 	"sort"
+	"strings"
 
 	"github.com/imdario/mergo"
 	"go.uber.org/zap"
 	"gopkg.in/yaml.v2"
 )
 
+// ApnProfile describes how a PDP context has to be set up for a particular APN.
+// Anything left empty falls back to the modem defaults we have always used.
+type ApnProfile struct {
+	AuthType  string // none, pap or chap
+	Username  string
+	Password  string
+	PDPType   string // IP, IPV6 or IPV4V6
+	ContextID int
+}
+
+// PDPContextConfig is an extra data session kept up next to the main APN, for example a
+// private management APN. InterfaceName and RoutingTable are only used on modems that
+// expose one network interface per context. Without its own interface a context carries no
+// traffic, its status reports it unusable.
+type PDPContextConfig struct {
+	Name          string
+	APN           string
+	Profile       ApnProfile
+	InterfaceName string
+	RoutingTable  int
+}
+
+// ConnectivityCheck is one step of the chain run on each uplink after ICMP. Type is dns (Target
+// is a hostname), tcp (host:port) or http (a URL answering ExpectStatus, and ExpectBody if set).
+type ConnectivityCheck struct {
+	Type         string
+	Target       string
+	ExpectStatus int
+	ExpectBody   string
+}
+
+// WifiNetwork is handed to wpa_supplicant as is. Set PSK for WPA personal, or EAP (e.g. PEAP)
+// with Identity and Password for enterprise networks. Leave both empty for open networks.
+type WifiNetwork struct {
+	SSID     string
+	PSK      string
+	EAP      string
+	Identity string
+	Password string
+	Priority int
+}
+
+// RouterConfig shares the active uplink with devices behind LanInterface. LanAddress is the
+// gateway address in CIDR form, the DHCP range has to sit inside it.
+type RouterConfig struct {
+	Enabled        bool
+	LanInterface   string
+	LanAddress     string
+	DHCPServer     bool
+	DHCPRangeStart string
+	DHCPRangeEnd   string
+	DHCPLeaseTime  int
+	DNS            []string
+}
+
+// WireGuardConfig is the management tunnel ops reach devices through. Keys are base64 as wg
+// prints them. A tunnel without a handshake for StaleHandshake seconds is reported stale, and
+// counts as lost connectivity on the uplink carrying it when StaleIsFailure is set.
+type WireGuardConfig struct {
+	Enabled             bool
+	Interface           string
+	PrivateKey          string
+	ListenPort          int
+	Address             string
+	PeerPublicKey       string
+	PeerEndpoint        string
+	AllowedIPs          []string
+	PersistentKeepalive int
+	StaleHandshake      int
+	StaleIsFailure      bool
+}
+
+// KeepaliveConfig stops the carrier from tearing down an idle PDP session or NAT binding.
+// Mode is "udp" with Target as host:port, or "icmp" with Target as a host. With Adaptive set
+// the NAT binding timeout is measured against StunServer and the interval set just under it,
+// never outside MinInterval and MaxInterval. The server has to support RESPONSE-PORT from
+// RFC 5780, so the binding is checked without refreshing it. Without it the measurement fails.
+type KeepaliveConfig struct {
+	Mode        string
+	Target      string
+	Interval    int
+	Adaptive    bool
+	StunServer  string
+	MinInterval int
+	MaxInterval int
+}
+
+// DataCapConfig is the quota of an interface per billing cycle, which starts on BillingDay (1-28) of
+// every month. Past WarnPercent of QuotaMB a warning is logged, past ActionPercent Action is
+// taken: "warn" only logs, "failover" moves traffic to another NetworkPriority interface and
+// "block" lets only AllowedDestinations, DNS and NTP through.
+type DataCapConfig struct {
+	QuotaMB       int
+	BillingDay    int
+	WarnPercent   int
+	ActionPercent int
+	Action        string
+}
+
+// ThroughputTestConfig downloads from DownloadURL and uploads to UploadURL out of each of
+// Interfaces, the modem interface when empty, moving at most MaxBytes each way. Interval is
+// in minutes, with 0 the test only runs on demand, when the daemon gets SIGUSR1. Scheduled
+// tests skip interfaces over their data cap and, with MeteredPolicy, the cellular ones. The
+// endpoints aren't let through traffic restrictions, add them to AllowedDestinations for that.
+type ThroughputTestConfig struct {
+	DownloadURL string
+	UploadURL   string
+	MaxBytes    int64
+	Timeout     int
+	Interval    int
+	Interfaces  []string
+}
+
+// PacketCaptureConfig captures on the modem interface for Duration seconds or until MaxPackets
+// packets, whichever comes first, when the daemon gets SIGUSR2. Filter is a tcpdump expression,
+// compiled with tcpdump since there is no libpcap here, so a filter needs tcpdump installed.
+// The capture stops once the file reaches MaxBytes and each packet is cut to SnapLength. Files
+// go into Directory, readable by root only, they hold whatever crossed the link.
+type PacketCaptureConfig struct {
+	Duration   int
+	MaxPackets int
+	Filter     string
+	MaxBytes   int64
+	SnapLength int
+	Directory  string
+}
+
+// NetworkLockConfig keeps the modem on one operator, given as MCCMNC, and on some bands and
+// radio access technologies. Bands are the parameters of the vendor's band command as the
+// modem takes them, for Quectel the GSM/WCDMA and LTE masks of AT+QCFG="band", e.g.
+// "0x0,0x80084", for Telit those of AT#BND. RAT is "auto" or "lte", and "catm" or "nbiot"
+// on the ME910C1. Empty Bands and RAT leave the modem as it is, an empty Operator goes back
+// to automatic selection if the modem is still on the operator it was locked to, a selection
+// made by hand stays. With EARFCN set the modem is kept on that LTE cell, PCI, and let go
+// of it when the cell has been gone for CellLostTimeout seconds. Cell lock is Quectel only, on
+// other modems the cell is rejected and the diagnosis reports the lock as unsupported.
+type NetworkLockConfig struct {
+	Operator        string
+	Bands           string
+	RAT             string
+	EARFCN          int
+	PCI             int
+	CellLostTimeout int
+}
+
 type Configuration struct {
 	VerboseMode                bool
 	DebugMode                  bool
@@ -20,9 +166,49 @@ type Configuration struct {
 	SendMonitoringDataInterval int
 	PingTimeout                int
 	OtherPingTimeout           int
+	IPv4PingTargets            []string
+	IPv6PingTargets            []string
+	ProbeCount                 int
+	ProbeInterval              int
+	ProbeQuorum                int
+	ConnectivityChecks         []ConnectivityCheck
+	InterfaceResetTimeout      int
 	NetworkPriority            map[string]int
+	WanCheckInterval           int
+	WanFailThreshold           int
+	WanRecoverThreshold        int
+	WanMetricStep              int
+	PolicyRouting              bool
+	PolicyRoutingTableBase     int
+	PolicyRoutingRulePriority  int
 	CellularInterfaces         []string
+	EthernetInterface          string
+	ArpTimeout                 int
+	WifiInterface              string
+	WifiNetworks               []WifiNetwork
+	WpaControlDir              string
+	Router                     RouterConfig
+	WireGuard                  WireGuardConfig
+	Keepalives                 map[string]KeepaliveConfig
+	DataCaps                   map[string]DataCapConfig
+	AllowedDestinations        []string
+	MeteredPolicy              bool
+	InterfaceMTU               map[string]int
+	PathMTUTarget              string
+	PathMTUAutoApply           bool
+	ThroughputTest             ThroughputTestConfig
+	TracerouteTarget           string
+	TracerouteMode             string
+	TracerouteMaxHops          int
+	DNSCheckHosts              []string
+	PublicDNSServers           []string
+	PacketCapture              PacketCaptureConfig
+	NetworkTimeSetClock        bool
+	NetworkTimeMaxSkew         int
+	NetworkLock                NetworkLockConfig
 	AcceptableAPNs             map[string]struct{}
+	APNProfiles                map[string]ApnProfile
+	PDPContexts                []PDPContextConfig
 	LoggerLevel                string
 	ReloadRequired             bool
 	ConfigChanged              bool
@@ -39,9 +225,82 @@ func (c *Configuration) SetDefaults() {
 	c.SendMonitoringDataInterval = 25
 	c.PingTimeout = 9
 	c.OtherPingTimeout = 3
+	c.IPv4PingTargets = []string{"8.8.8.8", "1.1.1.1", "9.9.9.9"}
+	c.IPv6PingTargets = []string{"2001:4860:4860::8888", "2606:4700:4700::1111", "2620:fe::fe"}
+	c.ProbeCount = 3
+	c.ProbeInterval = 200
+	c.ProbeQuorum = 2
+	c.ConnectivityChecks = []ConnectivityCheck{
+		{Type: "dns", Target: "connectivitycheck.gstatic.com"},
+		{Type: "tcp", Target: "connectivitycheck.gstatic.com:80"},
+		{Type: "http", Target: "http://connectivitycheck.gstatic.com/generate_204", ExpectStatus: 204},
+	}
+	c.InterfaceResetTimeout = 20
 	c.NetworkPriority = map[string]int{"eth0": 1, "wlan0": 2, "wwan0": 3, "usb0": 4}
+	c.WanCheckInterval = 30
+	c.WanFailThreshold = 3
+	c.WanRecoverThreshold = 3
+	c.WanMetricStep = 100
+	c.PolicyRouting = true
+	c.PolicyRoutingTableBase = 100
+	c.PolicyRoutingRulePriority = 1000
 	c.CellularInterfaces = []string{"wwan0", "usb0"}
+	c.EthernetInterface = "eth0"
+	c.ArpTimeout = 2
+	c.WifiInterface = "wlan0"
+	c.WifiNetworks = []WifiNetwork{}
+	c.WpaControlDir = "/var/run/wpa_supplicant"
+	c.Router = RouterConfig{
+		Enabled:        false,
+		LanInterface:   "eth0",
+		LanAddress:     "192.168.50.1/24",
+		DHCPServer:     true,
+		DHCPRangeStart: "192.168.50.100",
+		DHCPRangeEnd:   "192.168.50.199",
+		DHCPLeaseTime:  3600,
+		DNS:            []string{"8.8.8.8", "1.1.1.1"},
+	}
+	c.WireGuard = WireGuardConfig{
+		Enabled:             false,
+		Interface:           "wg0",
+		AllowedIPs:          []string{},
+		PersistentKeepalive: 25,
+		StaleHandshake:      300,
+		StaleIsFailure:      false,
+	}
+	c.Keepalives = map[string]KeepaliveConfig{}
+	c.DataCaps = map[string]DataCapConfig{}
+	c.AllowedDestinations = []string{}
+	c.MeteredPolicy = false
+	c.InterfaceMTU = map[string]int{}
+	c.PathMTUTarget = "8.8.8.8"
+	c.PathMTUAutoApply = false
+	c.ThroughputTest = ThroughputTestConfig{
+		MaxBytes:   1000000,
+		Timeout:    30,
+		Interval:   0,
+		Interfaces: []string{},
+	}
+	c.TracerouteTarget = "8.8.8.8"
+	c.TracerouteMode = "udp"
+	c.TracerouteMaxHops = 20
+	c.DNSCheckHosts = []string{"connectivitycheck.gstatic.com"}
+	c.PublicDNSServers = []string{"8.8.8.8", "1.1.1.1"}
+	c.PacketCapture = PacketCaptureConfig{
+		Duration:   30,
+		MaxPackets: 0,
+		MaxBytes:   10000000,
+		SnapLength: 262144,
+		Directory:  "captures",
+	}
+	c.NetworkTimeSetClock = false
+	c.NetworkTimeMaxSkew = 300
+	c.NetworkLock = NetworkLockConfig{
+		CellLostTimeout: 600,
+	}
 	c.AcceptableAPNs = map[string]struct{}{"super": {}, "de1.super": {}, "sg1.super": {}}
+	c.APNProfiles = map[string]ApnProfile{}
+	c.PDPContexts = []PDPContextConfig{}
 	c.LoggerLevel = "debug" // Is this needed?
 	c.ReloadRequired = false
 	c.ConfigChanged = false
@@ -58,9 +317,49 @@ func (c *Configuration) UpdateConfig(newConfig *Configuration) {
 	c.SendMonitoringDataInterval = newConfig.SendMonitoringDataInterval
 	c.PingTimeout = newConfig.PingTimeout
 	c.OtherPingTimeout = newConfig.OtherPingTimeout
+	c.IPv4PingTargets = newConfig.IPv4PingTargets
+	c.IPv6PingTargets = newConfig.IPv6PingTargets
+	c.ProbeCount = newConfig.ProbeCount
+	c.ProbeInterval = newConfig.ProbeInterval
+	c.ProbeQuorum = newConfig.ProbeQuorum
+	c.ConnectivityChecks = newConfig.ConnectivityChecks
+	c.InterfaceResetTimeout = newConfig.InterfaceResetTimeout
 	c.NetworkPriority = newConfig.NetworkPriority
+	c.WanCheckInterval = newConfig.WanCheckInterval
+	c.WanFailThreshold = newConfig.WanFailThreshold
+	c.WanRecoverThreshold = newConfig.WanRecoverThreshold
+	c.WanMetricStep = newConfig.WanMetricStep
+	c.PolicyRouting = newConfig.PolicyRouting
+	c.PolicyRoutingTableBase = newConfig.PolicyRoutingTableBase
+	c.PolicyRoutingRulePriority = newConfig.PolicyRoutingRulePriority
 	c.CellularInterfaces = newConfig.CellularInterfaces
+	c.EthernetInterface = newConfig.EthernetInterface
+	c.ArpTimeout = newConfig.ArpTimeout
+	c.WifiInterface = newConfig.WifiInterface
+	c.WifiNetworks = newConfig.WifiNetworks
+	c.WpaControlDir = newConfig.WpaControlDir
+	c.Router = newConfig.Router
+	c.WireGuard = newConfig.WireGuard
+	c.Keepalives = newConfig.Keepalives
+	c.DataCaps = newConfig.DataCaps
+	c.AllowedDestinations = newConfig.AllowedDestinations
+	c.MeteredPolicy = newConfig.MeteredPolicy
+	c.InterfaceMTU = newConfig.InterfaceMTU
+	c.PathMTUTarget = newConfig.PathMTUTarget
+	c.PathMTUAutoApply = newConfig.PathMTUAutoApply
+	c.ThroughputTest = newConfig.ThroughputTest
+	c.TracerouteTarget = newConfig.TracerouteTarget
+	c.TracerouteMode = newConfig.TracerouteMode
+	c.TracerouteMaxHops = newConfig.TracerouteMaxHops
+	c.DNSCheckHosts = newConfig.DNSCheckHosts
+	c.PublicDNSServers = newConfig.PublicDNSServers
+	c.PacketCapture = newConfig.PacketCapture
+	c.NetworkTimeSetClock = newConfig.NetworkTimeSetClock
+	c.NetworkTimeMaxSkew = newConfig.NetworkTimeMaxSkew
+	c.NetworkLock = newConfig.NetworkLock
 	c.AcceptableAPNs = newConfig.AcceptableAPNs
+	c.APNProfiles = newConfig.APNProfiles
+	c.PDPContexts = newConfig.PDPContexts
 	c.LoggerLevel = newConfig.LoggerLevel // Is this needed?
 	c.ReloadRequired = newConfig.ReloadRequired
 	c.ConfigChanged = newConfig.ConfigChanged
@@ -68,6 +367,77 @@ func (c *Configuration) UpdateConfig(newConfig *Configuration) {
 	c.LogConfigRequired = newConfig.LogConfigRequired
 }
 
+// ApnProfile returns the profile for an APN with the defaults filled in
+func (c *Configuration) ApnProfile(apn string) ApnProfile {
+	profile := c.APNProfiles[apn].withDefaults()
+
+	if profile.ContextID == 0 {
+		profile.ContextID = 1
+	}
+
+	return profile
+}
+
+func (p ApnProfile) withDefaults() ApnProfile {
+	if p.AuthType == "" {
+		p.AuthType = "none"
+	}
+	p.AuthType = strings.ToLower(p.AuthType)
+
+	if p.PDPType == "" {
+		p.PDPType = "IPV4V6"
+	}
+	p.PDPType = strings.ToUpper(p.PDPType)
+
+	return p
+}
+
+func (k KeepaliveConfig) withDefaults() KeepaliveConfig {
+	if k.Mode == "" {
+		k.Mode = "udp"
+	}
+	k.Mode = strings.ToLower(k.Mode)
+
+	if k.Interval == 0 {
+		k.Interval = 60
+	}
+
+	if k.StunServer == "" {
+		k.StunServer = "stun.stunprotocol.org:3478"
+	}
+
+	if k.MinInterval == 0 {
+		k.MinInterval = 20
+	}
+
+	if k.MaxInterval == 0 {
+		k.MaxInterval = 600
+	}
+
+	return k
+}
+
+func (d DataCapConfig) withDefaults() DataCapConfig {
+	if d.BillingDay < 1 || d.BillingDay > 28 {
+		d.BillingDay = 1
+	}
+
+	if d.WarnPercent == 0 {
+		d.WarnPercent = 80
+	}
+
+	if d.ActionPercent == 0 {
+		d.ActionPercent = 100
+	}
+
+	if d.Action == "" {
+		d.Action = "warn"
+	}
+	d.Action = strings.ToLower(d.Action)
+
+	return d
+}
+
 var Config = Configuration{}
 var oldConfig = Configuration{}
 
@@ -133,6 +503,18 @@ func Configure() {
 			Config.ModemConfigRequired = true
 		}
 
+		// A request without a network lock leaves the current one in place
+		if update.NetworkLock != (NetworkLockConfig{}) && update.NetworkLock != Config.NetworkLock {
+			Config.ModemConfigRequired = true
+		}
+
+		// The APN ladder and the contexts are only written to the modem while configuring it
+		if (update.AcceptableAPNs != nil && !reflect.DeepEqual(Config.AcceptableAPNs, update.AcceptableAPNs)) ||
+			(update.APNProfiles != nil && !reflect.DeepEqual(Config.APNProfiles, update.APNProfiles)) ||
+			(update.PDPContexts != nil && !reflect.DeepEqual(Config.PDPContexts, update.PDPContexts)) {
+			Config.ModemConfigRequired = true
+		}
+
 		// TODO: Actually implement the ability to change logging style with config files
 
 		if err := mergo.Merge(&Config, configFileContent, mergo.WithOverride); err != nil {
@@ -146,7 +528,9 @@ func Configure() {
 			zap.S().Error("Error parsing configuration, err: %v", err)
 		}
 
-		os.WriteFile("config.yaml", systemConfig, 0644)
+		// It holds the WireGuard keys and the Wi-Fi and APN passwords, root only
+		os.WriteFile("config.yaml", systemConfig, 0600)
+		os.Chmod("config.yaml", 0600)
 	}
 
 	if Config.ModemConfigRequired {
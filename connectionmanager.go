@@ -1,6 +1,8 @@
 package main
 
 import (
+	"errors"
+
 	"go.uber.org/zap"
 )
 
@@ -79,6 +81,9 @@ func checkSimReady() {
 func checkNetwork() {
 	conductor.SetStep(0, 3, 4, 13, 5, false, 120)
 
+	// A locked cell that went away is also how registration gets lost
+	cellLock.Check(&networkModem)
+
 	err := networkModem.CheckNetwork()
 	if err != nil {
 		conductor.IsOk = false
@@ -86,6 +91,7 @@ func checkNetwork() {
 		return
 	}
 
+	networkModem.SyncNetworkTime()
 	conductor.IsOk = true
 }
 
@@ -96,9 +102,31 @@ func initiateECM() {
 	if err != nil {
 		conductor.IsOk = false
 		zap.S().Error("error initiating ecm, error: %v", err)
+
+		// Registered but no data session usually means the APN is wrong for this SIM
+		if errors.Is(err, errEcmTimeout) {
+			err = networkModem.NextApn()
+			if err != nil {
+				zap.S().Errorf("error switching to the next apn, error: %v", err)
+			}
+		}
 		return
 	}
 
+	networkModem.RecordWorkingApn()
+
+	err = applyConfiguredMTU(networkModem.InterfaceName)
+	if err != nil {
+		zap.S().Errorf("error applying mtu, error: %v", err)
+	}
+	networkModem.ActivateAdditionalContexts()
+
+	_, err = networkModem.UpdatePDPAddressing()
+	if err != nil {
+		zap.S().Errorf("error reading pdp context addressing, error: %v", err)
+	}
+
+	wireGuard.Rehandshake()
 	conductor.IsOk = true
 }
 
@@ -118,6 +146,10 @@ func checkInternet() {
 		conductor.IsOk = false
 	}
 
+	// Extra contexts are looked after on their own and never move the conductor
+	networkModem.CheckAdditionalContexts()
+	cellLock.Check(&networkModem)
+
 	if networkModem.IncidentFlag == true {
 		networkModem.MonitoringProperties.FixedIncident++
 		networkModem.IncidentFlag = false
@@ -159,6 +191,8 @@ func resetConnectionInterface() {
 	if err != nil {
 		zap.S().Error("error occured during connection interface reset, error: %v", err)
 		conductor.IsOk = false
+	} else {
+		wireGuard.Rehandshake()
 	}
 
 	conductor.IsOk = true
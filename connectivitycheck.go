@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+)
+
+type CheckOutcome struct {
+	Type   string
+	Target string
+	Passed bool
+	Detail string
+}
+
+// ConnectivityResult says how far up the stack an interface works. FailedLayer is empty when
+// every check passed, otherwise it is the type of the first check that didn't.
+type ConnectivityResult struct {
+	FailedLayer   string
+	CaptivePortal bool
+	Checks        []CheckOutcome
+}
+
+// boundDialer dials out of one interface regardless of the routing table
+func boundDialer(interfaceName string, timeout time.Duration) *net.Dialer {
+	return &net.Dialer{
+		Timeout: timeout,
+		Control: func(network, address string, rawConn syscall.RawConn) error {
+			var bindErr error
+			err := rawConn.Control(func(fd uintptr) {
+				bindErr = unix.BindToDevice(int(fd), interfaceName)
+			})
+			if err != nil {
+				return err
+			}
+			return bindErr
+		},
+	}
+}
+
+// Nameservers learned for an interface, e.g. the carrier DNS from the PDP context. Kept
+// behind their own mutex since the checks run on both the conductor and the WAN goroutines.
+var interfaceNameservers = struct {
+	sync.Mutex
+	servers map[string][]string
+}{servers: map[string][]string{}}
+
+func setInterfaceNameservers(interfaceName string, servers []string) {
+	interfaceNameservers.Lock()
+	defer interfaceNameservers.Unlock()
+	interfaceNameservers.servers[interfaceName] = append([]string{}, servers...)
+}
+
+// systemNameservers reads resolv.conf, leaving out loopback servers: a local stub such as
+// systemd-resolved or dnsmasq can't be reached from a socket bound to an uplink
+func systemNameservers() []string {
+	content, err := os.ReadFile("/etc/resolv.conf")
+	if err != nil {
+		return nil
+	}
+
+	servers := []string{}
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "nameserver" {
+			continue
+		}
+
+		ip := net.ParseIP(strings.Split(fields[1], "%")[0])
+		if ip == nil || ip.IsLoopback() {
+			continue
+		}
+		servers = append(servers, ip.String())
+	}
+
+	return servers
+}
+
+// uplinkNameservers picks the servers to check DNS with on an interface: its own when known,
+// else the non-loopback system ones, else the public ones
+func uplinkNameservers(interfaceName string) []string {
+	interfaceNameservers.Lock()
+	servers := interfaceNameservers.servers[interfaceName]
+	interfaceNameservers.Unlock()
+
+	if len(servers) > 0 {
+		return servers
+	}
+
+	servers = systemNameservers()
+	if len(servers) > 0 {
+		return servers
+	}
+
+	return Config.PublicDNSServers
+}
+
+func checkDNS(interfaceName string, check ConnectivityCheck, timeout time.Duration) CheckOutcome {
+	outcome := CheckOutcome{Type: "dns", Target: check.Target}
+
+	failures := []string{}
+	for _, server := range uplinkNameservers(interfaceName) {
+		result := resolveWith(interfaceName, server, check.Target, timeout)
+		if result.Error != "" {
+			failures = append(failures, fmt.Sprintf("%s: %s", server, result.Error))
+			continue
+		}
+
+		outcome.Passed = len(result.Addresses) > 0
+		outcome.Detail = strings.Join(result.Addresses, ", ")
+		return outcome
+	}
+
+	if len(failures) == 0 {
+		outcome.Detail = "no nameservers to check with"
+	} else {
+		outcome.Detail = strings.Join(failures, "; ")
+	}
+	return outcome
+}
+
+func checkTCP(interfaceName string, check ConnectivityCheck, timeout time.Duration) CheckOutcome {
+	outcome := CheckOutcome{Type: "tcp", Target: check.Target}
+
+	start := time.Now()
+	conn, err := boundDialer(interfaceName, timeout).Dial("tcp", check.Target)
+	if err != nil {
+		outcome.Detail = err.Error()
+		return outcome
+	}
+	conn.Close()
+
+	outcome.Passed = true
+	outcome.Detail = fmt.Sprintf("connected in %v", time.Since(start).Round(time.Millisecond))
+	return outcome
+}
+
+// checkHTTP fetches the target without following redirects. Anything other than the expected
+// status or body means something between us and the server answered instead: a captive portal
+// redirecting us, or a transparent proxy rewriting the response.
+func checkHTTP(interfaceName string, check ConnectivityCheck, timeout time.Duration) (CheckOutcome, bool) {
+	outcome := CheckOutcome{Type: "http", Target: check.Target}
+
+	client := &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext:       boundDialer(interfaceName, timeout).DialContext,
+			DisableKeepAlives: true,
+		},
+		CheckRedirect: func(request *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	response, err := client.Get(check.Target)
+	if err != nil {
+		outcome.Detail = err.Error()
+		return outcome, false
+	}
+	defer response.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(response.Body, 4096))
+	if err != nil {
+		outcome.Detail = err.Error()
+		return outcome, false
+	}
+
+	expectedStatus := check.ExpectStatus
+	if expectedStatus == 0 {
+		expectedStatus = http.StatusOK
+	}
+
+	if response.StatusCode != expectedStatus {
+		outcome.Detail = fmt.Sprintf("expected status %d, got %d", expectedStatus, response.StatusCode)
+		if location := response.Header.Get("Location"); location != "" {
+			outcome.Detail += fmt.Sprintf(", redirected to %s", location)
+		}
+		return outcome, true
+	}
+
+	if check.ExpectBody != "" && !strings.Contains(string(body), check.ExpectBody) {
+		outcome.Detail = fmt.Sprintf("response didn't contain %q", check.ExpectBody)
+		return outcome, true
+	}
+
+	outcome.Passed = true
+	outcome.Detail = fmt.Sprintf("status %d", response.StatusCode)
+	return outcome, false
+}
+
+// runConnectivityChecks runs the configured chain in order on one interface. The chain keeps
+// going after a failure so the report shows every layer, not just the first broken one.
+func runConnectivityChecks(interfaceName string, timeout time.Duration) ConnectivityResult {
+	result := ConnectivityResult{}
+
+	for _, check := range Config.ConnectivityChecks {
+		var outcome CheckOutcome
+		switch strings.ToLower(check.Type) {
+		case "dns":
+			outcome = checkDNS(interfaceName, check, timeout)
+		case "tcp":
+			outcome = checkTCP(interfaceName, check, timeout)
+		case "http":
+			var intercepted bool
+			outcome, intercepted = checkHTTP(interfaceName, check, timeout)
+			result.CaptivePortal = result.CaptivePortal || intercepted
+		default:
+			outcome = CheckOutcome{Type: check.Type, Target: check.Target, Detail: "unknown check type"}
+		}
+
+		if !outcome.Passed && result.FailedLayer == "" {
+			result.FailedLayer = outcome.Type
+		}
+		result.Checks = append(result.Checks, outcome)
+	}
+
+	return result
+}
+
+// checkUplinkConnectivity decides whether an interface has internet. ICMP always runs since it
+// gives us latency, but when a check chain is configured that is what decides: some carriers
+// drop ICMP entirely, others answer it while everything else waits on a captive portal.
+func checkUplinkConnectivity(interfaceName string, pingTimeout int) (FamilyHealth, ConnectivityResult, error) {
+	health, icmpErr := checkDualStackHealth(interfaceName, pingTimeout)
+
+	if len(Config.ConnectivityChecks) == 0 {
+		result := ConnectivityResult{}
+		if icmpErr != nil {
+			result.FailedLayer = "icmp"
+		}
+		return health, result, icmpErr
+	}
+
+	result := runConnectivityChecks(interfaceName, time.Duration(pingTimeout)*time.Second)
+
+	if result.CaptivePortal {
+		zap.S().Warnf("%s looks like it is behind a captive portal or transparent proxy", interfaceName)
+	}
+
+	if result.FailedLayer != "" {
+		return health, result, fmt.Errorf("%s check failed on %s", result.FailedLayer, interfaceName)
+	}
+
+	if icmpErr != nil {
+		zap.S().Infof("%s doesn't answer ICMP but every other check passed, error: %v", interfaceName, icmpErr)
+	}
+
+	return health, result, nil
+}
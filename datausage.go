@@ -0,0 +1,259 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// Counters are written to the state at most this often, the SD card doesn't like more
+	usageSaveInterval = 10 * time.Minute
+	usageDaysKept     = 62
+	usageCyclesKept   = 13
+	usageDateLayout   = "2006-01-02"
+)
+
+type UsageTotals struct {
+	RxBytes uint64
+	TxBytes uint64
+}
+
+func (u UsageTotals) Total() uint64 {
+	return u.RxBytes + u.TxBytes
+}
+
+// InterfaceUsage is what gets persisted per interface. The last raw kernel counters are kept
+// so the next reading only adds what is new. They start over after a reboot or when the
+// interface is recreated, which the boot ID and interface index next to them tell.
+type InterfaceUsage struct {
+	CounterRxBytes uint64
+	CounterTxBytes uint64
+	BootID         string
+	InterfaceIndex int
+	Daily          map[string]UsageTotals // keyed by date
+	Cycles         map[string]UsageTotals // keyed by the date the billing cycle started
+}
+
+type DataUsageStatus struct {
+	Today       UsageTotals
+	Cycle       UsageTotals
+	CycleStart  string
+	QuotaMB     int
+	UsedPercent float64
+	Warning     bool
+	Capped      bool
+	Action      string
+}
+
+type DataUsage struct {
+	bootID      string
+	readBoot    sync.Once
+	lastSaved   time.Time
+	statuses    map[string]DataUsageStatus
+	restriction TrafficRestriction
+}
+
+var dataUsage = DataUsage{
+	statuses:    map[string]DataUsageStatus{},
+	restriction: TrafficRestriction{table: "cm_datacap"},
+}
+
+// billingCycleStart is the last BillingDay on or before now
+func billingCycleStart(now time.Time, billingDay int) time.Time {
+	start := time.Date(now.Year(), now.Month(), billingDay, 0, 0, 0, 0, now.Location())
+	if now.Before(start) {
+		start = start.AddDate(0, -1, 0)
+	}
+
+	return start
+}
+
+// counterDelta is what a counter moved since the previous reading. After it started over all
+// of it is new, even when traffic already pushed it past the previous reading.
+func counterDelta(previous uint64, current uint64, reset bool) uint64 {
+	if reset || current < previous {
+		return current
+	}
+
+	return current - previous
+}
+
+// readBootID tells boots apart, the kernel makes up a new one on every boot
+func readBootID() string {
+	bootID, err := os.ReadFile("/proc/sys/kernel/random/boot_id")
+	if err != nil {
+		zap.S().Warnf("unable to read boot id, counter resets are only seen when counters drop, error: %v", err)
+		return ""
+	}
+
+	return strings.TrimSpace(string(bootID))
+}
+
+// pruneUsage drops the oldest entries, dates sort the same as strings
+func pruneUsage(totals map[string]UsageTotals, keep int) {
+	for len(totals) > keep {
+		oldest := ""
+		for date := range totals {
+			if oldest == "" || date < oldest {
+				oldest = date
+			}
+		}
+		delete(totals, oldest)
+	}
+}
+
+func (d *DataUsage) account(interfaceName string, link InterfaceState, now time.Time) {
+	if state.DataUsage == nil {
+		state.DataUsage = map[string]*InterfaceUsage{}
+	}
+
+	usage, ok := state.DataUsage[interfaceName]
+	if !ok {
+		// Whatever went through before we started counting isn't ours to bill
+		state.DataUsage[interfaceName] = &InterfaceUsage{
+			CounterRxBytes: link.RxBytes,
+			CounterTxBytes: link.TxBytes,
+			BootID:         d.bootID,
+			InterfaceIndex: link.Index,
+			Daily:          map[string]UsageTotals{},
+			Cycles:         map[string]UsageTotals{},
+		}
+		return
+	}
+
+	// Counters saved before the boot ID was kept can only be checked for dropping
+	reset := usage.BootID != "" && d.bootID != "" &&
+		(usage.BootID != d.bootID || usage.InterfaceIndex != link.Index)
+	rx := counterDelta(usage.CounterRxBytes, link.RxBytes, reset)
+	tx := counterDelta(usage.CounterTxBytes, link.TxBytes, reset)
+	usage.CounterRxBytes = link.RxBytes
+	usage.CounterTxBytes = link.TxBytes
+	usage.BootID = d.bootID
+	usage.InterfaceIndex = link.Index
+
+	if usage.Daily == nil {
+		usage.Daily = map[string]UsageTotals{}
+	}
+	if usage.Cycles == nil {
+		usage.Cycles = map[string]UsageTotals{}
+	}
+
+	day := now.Format(usageDateLayout)
+	today := usage.Daily[day]
+	today.RxBytes += rx
+	today.TxBytes += tx
+	usage.Daily[day] = today
+	pruneUsage(usage.Daily, usageDaysKept)
+
+	dataCap := Config.DataCaps[interfaceName].withDefaults()
+	cycleStart := billingCycleStart(now, dataCap.BillingDay).Format(usageDateLayout)
+	cycle := usage.Cycles[cycleStart]
+	cycle.RxBytes += rx
+	cycle.TxBytes += tx
+	usage.Cycles[cycleStart] = cycle
+	pruneUsage(usage.Cycles, usageCyclesKept)
+}
+
+func (d *DataUsage) updateStatus(interfaceName string, now time.Time) {
+	usage, ok := state.DataUsage[interfaceName]
+	if !ok {
+		return
+	}
+
+	previous := d.statuses[interfaceName]
+	dataCap, hasCap := Config.DataCaps[interfaceName]
+	dataCap = dataCap.withDefaults()
+	cycleStart := billingCycleStart(now, dataCap.BillingDay).Format(usageDateLayout)
+
+	status := DataUsageStatus{
+		Today:      usage.Daily[now.Format(usageDateLayout)],
+		Cycle:      usage.Cycles[cycleStart],
+		CycleStart: cycleStart,
+	}
+
+	if hasCap && dataCap.QuotaMB > 0 {
+		status.QuotaMB = dataCap.QuotaMB
+		status.Action = dataCap.Action
+		status.UsedPercent = 100 * float64(status.Cycle.Total()) / (float64(dataCap.QuotaMB) * 1e6)
+		status.Warning = status.UsedPercent >= float64(dataCap.WarnPercent)
+		status.Capped = status.UsedPercent >= float64(dataCap.ActionPercent)
+	}
+
+	if status.Warning && !previous.Warning {
+		zap.S().Warnf("%s used %.0f%% of its %d MB quota this cycle", interfaceName, status.UsedPercent, status.QuotaMB)
+	}
+	if status.Capped && !previous.Capped {
+		zap.S().Warnf("%s reached its data cap, action: %s", interfaceName, status.Action)
+	}
+	if !status.Capped && previous.Capped {
+		zap.S().Infof("%s is back under its data cap", interfaceName)
+	}
+
+	d.statuses[interfaceName] = status
+}
+
+// Update reads the kernel counters of every uplink and adds what is new to the daily and
+// billing cycle totals. Callers hold the global lock since the state is shared.
+func (d *DataUsage) Update() {
+	d.readBoot.Do(func() {
+		d.bootID = readBootID()
+	})
+
+	states, err := getInterfaceStates()
+	if err != nil {
+		zap.S().Errorf("unable to read interface counters, error: %v", err)
+		return
+	}
+
+	now := time.Now()
+	for _, interfaceName := range uplinksByPriority() {
+		link, ok := states[interfaceName]
+		if !ok {
+			continue
+		}
+		d.account(interfaceName, link, now)
+		d.updateStatus(interfaceName, now)
+	}
+
+	if time.Since(d.lastSaved) >= usageSaveInterval {
+		err = saveState(&state)
+		if err != nil {
+			zap.S().Errorf("unable to save data usage, error: %v", err)
+			return
+		}
+		d.lastSaved = now
+	}
+}
+
+// FailoverRequired tells the WAN manager to treat a capped interface as failed
+func (d *DataUsage) FailoverRequired(interfaceName string) bool {
+	status := d.statuses[interfaceName]
+	return status.Capped && status.Action == "failover"
+}
+
+// Enforce restricts every interface over its cap with the block action
+func (d *DataUsage) Enforce() {
+	blocked := []string{}
+	for interfaceName, status := range d.statuses {
+		if status.Capped && status.Action == "block" {
+			blocked = append(blocked, interfaceName)
+		}
+	}
+
+	err := d.restriction.Apply(blocked)
+	if err != nil {
+		zap.S().Errorf("unable to enforce data caps, error: %v", err)
+	}
+}
+
+func (d *DataUsage) Statuses() map[string]DataUsageStatus {
+	statuses := map[string]DataUsageStatus{}
+	for interfaceName, status := range d.statuses {
+		statuses[interfaceName] = status
+	}
+	return statuses
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// withUsageState runs a test on an empty state and configuration, restoring both after it
+func withUsageState(t *testing.T) {
+	savedState, savedConfig := state, Config
+	t.Cleanup(func() {
+		state, Config = savedState, savedConfig
+	})
+	state = State{}
+	Config = Configuration{}
+}
+
+func TestCounterDelta(t *testing.T) {
+	tests := []struct {
+		previous uint64
+		current  uint64
+		reset    bool
+		want     uint64
+	}{
+		{1000, 1500, false, 500},
+		{1000, 1000, false, 0},
+		{1000, 300, false, 300},
+		{1000, 300, true, 300},
+		// Started over and already past the old reading
+		{1000, 5000, true, 5000},
+	}
+
+	for _, test := range tests {
+		if got := counterDelta(test.previous, test.current, test.reset); got != test.want {
+			t.Errorf("counterDelta(%d, %d, %t) = %d, want %d", test.previous, test.current, test.reset, got, test.want)
+		}
+	}
+}
+
+func TestAccountCounterResets(t *testing.T) {
+	now := time.Date(2026, 3, 14, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name      string
+		saved     InterfaceUsage
+		bootID    string
+		link      InterfaceState
+		wantTotal uint64
+	}{
+		{"same boot", InterfaceUsage{CounterRxBytes: 1000, CounterTxBytes: 100, BootID: "a", InterfaceIndex: 3},
+			"a", InterfaceState{Index: 3, RxBytes: 4000, TxBytes: 400}, 3300},
+		{"reboot past old reading", InterfaceUsage{CounterRxBytes: 1000, CounterTxBytes: 100, BootID: "a", InterfaceIndex: 3},
+			"b", InterfaceState{Index: 3, RxBytes: 4000, TxBytes: 400}, 4400},
+		{"interface recreated", InterfaceUsage{CounterRxBytes: 1000, CounterTxBytes: 100, BootID: "a", InterfaceIndex: 3},
+			"a", InterfaceState{Index: 7, RxBytes: 4000, TxBytes: 400}, 4400},
+		{"saved without boot id", InterfaceUsage{CounterRxBytes: 1000, CounterTxBytes: 100},
+			"a", InterfaceState{Index: 3, RxBytes: 4000, TxBytes: 400}, 3300},
+		{"saved without boot id, counter dropped", InterfaceUsage{CounterRxBytes: 1000, CounterTxBytes: 100},
+			"a", InterfaceState{Index: 3, RxBytes: 500, TxBytes: 50}, 550},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			withUsageState(t)
+			saved := test.saved
+			state.DataUsage = map[string]*InterfaceUsage{"wwan0": &saved}
+
+			usage := DataUsage{bootID: test.bootID, statuses: map[string]DataUsageStatus{}}
+			usage.account("wwan0", test.link, now)
+
+			if total := state.DataUsage["wwan0"].Daily["2026-03-14"].Total(); total != test.wantTotal {
+				t.Errorf("accounted %d bytes, want %d", total, test.wantTotal)
+			}
+			if saved.BootID != test.bootID || saved.InterfaceIndex != test.link.Index {
+				t.Errorf("kept boot id %q and index %d, want %q and %d",
+					saved.BootID, saved.InterfaceIndex, test.bootID, test.link.Index)
+			}
+		})
+	}
+}
+
+func TestDataCapStatus(t *testing.T) {
+	now := time.Date(2026, 3, 14, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name        string
+		dataCap     *DataCapConfig
+		cycleBytes  uint64
+		wantWarning bool
+		wantCapped  bool
+		wantAction  string
+	}{
+		{"no cap", nil, 1e12, false, false, ""},
+		{"under warning", &DataCapConfig{QuotaMB: 1000}, 700e6, false, false, "warn"},
+		{"warning", &DataCapConfig{QuotaMB: 1000}, 800e6, true, false, "warn"},
+		{"capped", &DataCapConfig{QuotaMB: 1000, Action: "Block"}, 1000e6, true, true, "block"},
+		{"early action", &DataCapConfig{QuotaMB: 1000, ActionPercent: 90, Action: "failover"}, 900e6, true, true, "failover"},
+		// Past what fits in a 32-bit int of bytes
+		{"large quota", &DataCapConfig{QuotaMB: 5000000}, 3e12, false, false, "warn"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			withUsageState(t)
+			if test.dataCap != nil {
+				Config.DataCaps = map[string]DataCapConfig{"wwan0": *test.dataCap}
+			}
+			state.DataUsage = map[string]*InterfaceUsage{"wwan0": {
+				Cycles: map[string]UsageTotals{"2026-03-01": {RxBytes: test.cycleBytes}},
+			}}
+
+			usage := DataUsage{statuses: map[string]DataUsageStatus{}}
+			usage.updateStatus("wwan0", now)
+			status := usage.Statuses()["wwan0"]
+
+			if status.Warning != test.wantWarning || status.Capped != test.wantCapped || status.Action != test.wantAction {
+				t.Errorf("got warning %t, capped %t, action %q, want %t, %t, %q",
+					status.Warning, status.Capped, status.Action, test.wantWarning, test.wantCapped, test.wantAction)
+			}
+			if usage.FailoverRequired("wwan0") != (test.wantCapped && test.wantAction == "failover") {
+				t.Errorf("failover required is %t with %+v", usage.FailoverRequired("wwan0"), status)
+			}
+		})
+	}
+}
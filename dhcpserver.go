@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+)
+
+// DHCP message types and options from RFC 2132, only the ones a small LAN server needs
+const (
+	dhcpDiscover = 1
+	dhcpOffer    = 2
+	dhcpRequest  = 3
+	dhcpDecline  = 4
+	dhcpAck      = 5
+	dhcpNak      = 6
+	dhcpRelease  = 7
+
+	dhcpOptionSubnetMask    = 1
+	dhcpOptionRouter        = 3
+	dhcpOptionDNS           = 6
+	dhcpOptionRequestedIP   = 50
+	dhcpOptionLeaseTime     = 51
+	dhcpOptionMessageType   = 53
+	dhcpOptionServerId      = 54
+	dhcpOptionEnd           = 255
+	dhcpOptionPad           = 0
+	dhcpHeaderLength        = 236
+	dhcpMagicCookie         = 0x63825363
+	dhcpBroadcastFlag       = 0x8000
+	dhcpServerPort          = 67
+	dhcpClientPort          = 68
+	dhcpMinimumPacketLength = 300
+
+	// How long an offered address stays set aside for the client's request
+	dhcpOfferTimeout = time.Minute
+	// A declined address is in use by some other host, it stays out of the pool this long
+	dhcpDeclineHoldDown = 10 * time.Minute
+)
+
+type DHCPLease struct {
+	MAC    string
+	IP     string
+	Expiry time.Time
+}
+
+// DHCPServer hands out addresses on the LAN side in router mode. It keeps leases in memory
+// only, clients renew well within a reboot of the gateway and simply get a fresh one.
+type DHCPServer struct {
+	interfaceName string
+	serverIP      net.IP
+	network       net.IPNet
+	rangeStart    net.IP
+	rangeEnd      net.IP
+	leaseTime     time.Duration
+	dns           []net.IP
+
+	mutex  sync.Mutex
+	leases map[string]DHCPLease
+	offers map[string]DHCPLease
+	// Declined addresses and until when they are held back
+	declined map[string]time.Time
+	conn     net.PacketConn
+}
+
+func newDHCPServer(router RouterConfig) (*DHCPServer, error) {
+	serverIP, network, err := net.ParseCIDR(router.LanAddress)
+	if err != nil || serverIP.To4() == nil {
+		return nil, fmt.Errorf("router lan address %q must be an ipv4 cidr", router.LanAddress)
+	}
+
+	rangeStart := net.ParseIP(router.DHCPRangeStart).To4()
+	rangeEnd := net.ParseIP(router.DHCPRangeEnd).To4()
+	if rangeStart == nil || rangeEnd == nil || !network.Contains(rangeStart) || !network.Contains(rangeEnd) ||
+		ipToUint32(rangeStart) > ipToUint32(rangeEnd) {
+		return nil, fmt.Errorf("dhcp range %s-%s isn't inside %s", router.DHCPRangeStart, router.DHCPRangeEnd, network)
+	}
+
+	dns := []net.IP{}
+	for _, server := range router.DNS {
+		if ip := net.ParseIP(server).To4(); ip != nil {
+			dns = append(dns, ip)
+		}
+	}
+	if len(dns) == 0 {
+		dns = append(dns, serverIP.To4())
+	}
+
+	return &DHCPServer{
+		interfaceName: router.LanInterface,
+		serverIP:      serverIP.To4(),
+		network:       *network,
+		rangeStart:    rangeStart,
+		rangeEnd:      rangeEnd,
+		leaseTime:     time.Duration(router.DHCPLeaseTime) * time.Second,
+		dns:           dns,
+		leases:        map[string]DHCPLease{},
+		offers:        map[string]DHCPLease{},
+		declined:      map[string]time.Time{},
+	}, nil
+}
+
+func ipToUint32(ip net.IP) uint32 {
+	return binary.BigEndian.Uint32(ip.To4())
+}
+
+func uint32ToIP(value uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, value)
+	return ip
+}
+
+func (d *DHCPServer) Start() error {
+	listenConfig := net.ListenConfig{
+		Control: func(network, address string, rawConn syscall.RawConn) error {
+			var socketErr error
+			err := rawConn.Control(func(fd uintptr) {
+				socketErr = unix.BindToDevice(int(fd), d.interfaceName)
+				if socketErr == nil {
+					socketErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_BROADCAST, 1)
+				}
+				if socketErr == nil {
+					socketErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
+				}
+			})
+			if err != nil {
+				return err
+			}
+			return socketErr
+		},
+	}
+
+	conn, err := listenConfig.ListenPacket(context.Background(), "udp4", fmt.Sprintf(":%d", dhcpServerPort))
+	if err != nil {
+		return fmt.Errorf("unable to listen for dhcp on %s, error: %v", d.interfaceName, err)
+	}
+	d.conn = conn
+
+	go d.serve()
+	zap.S().Infof("dhcp server running on %s for %s-%s", d.interfaceName, d.rangeStart, d.rangeEnd)
+	return nil
+}
+
+func (d *DHCPServer) Stop() {
+	if d.conn != nil {
+		d.conn.Close()
+	}
+}
+
+func (d *DHCPServer) Leases() []DHCPLease {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	leases := []DHCPLease{}
+	for _, lease := range d.leases {
+		leases = append(leases, lease)
+	}
+	return leases
+}
+
+func (d *DHCPServer) serve() {
+	buffer := make([]byte, 1500)
+	for {
+		length, _, err := d.conn.ReadFrom(buffer)
+		if err != nil {
+			zap.S().Infof("dhcp server on %s stopped, error: %v", d.interfaceName, err)
+			return
+		}
+
+		reply := d.handle(buffer[:length])
+		if reply == nil {
+			continue
+		}
+
+		// Clients without an address can only hear broadcasts
+		_, err = d.conn.WriteTo(reply, &net.UDPAddr{IP: net.IPv4bcast, Port: dhcpClientPort})
+		if err != nil {
+			zap.S().Errorf("unable to send dhcp reply on %s, error: %v", d.interfaceName, err)
+		}
+	}
+}
+
+func parseDHCPOptions(options []byte) map[byte][]byte {
+	parsed := map[byte][]byte{}
+	for i := 0; i < len(options); {
+		code := options[i]
+		if code == dhcpOptionEnd {
+			break
+		}
+		if code == dhcpOptionPad {
+			i++
+			continue
+		}
+		if i+1 >= len(options) || i+2+int(options[i+1]) > len(options) {
+			break
+		}
+		length := int(options[i+1])
+		parsed[code] = options[i+2 : i+2+length]
+		i += 2 + length
+	}
+
+	return parsed
+}
+
+// allocate returns the address for a client: the one it already has or was offered, the one
+// it asks for if free, or the first free one in the range. Addresses offered to other clients
+// count as taken until their offer runs out.
+func (d *DHCPServer) allocate(mac string, requested net.IP) net.IP {
+	now := time.Now()
+	taken := map[uint32]bool{}
+	for _, leases := range []map[string]DHCPLease{d.leases, d.offers} {
+		for leaseMac, lease := range leases {
+			if leaseMac != mac && lease.Expiry.After(now) {
+				taken[ipToUint32(net.ParseIP(lease.IP))] = true
+			}
+		}
+	}
+	for ip, until := range d.declined {
+		if until.After(now) {
+			taken[ipToUint32(net.ParseIP(ip))] = true
+		} else {
+			delete(d.declined, ip)
+		}
+	}
+	taken[ipToUint32(d.serverIP)] = true
+
+	for _, leases := range []map[string]DHCPLease{d.leases, d.offers} {
+		if lease, ok := leases[mac]; ok && !taken[ipToUint32(net.ParseIP(lease.IP))] {
+			return net.ParseIP(lease.IP).To4()
+		}
+	}
+
+	if requested != nil && requested.To4() != nil {
+		value := ipToUint32(requested)
+		if value >= ipToUint32(d.rangeStart) && value <= ipToUint32(d.rangeEnd) && !taken[value] {
+			return requested.To4()
+		}
+	}
+
+	for value := ipToUint32(d.rangeStart); value <= ipToUint32(d.rangeEnd); value++ {
+		if !taken[value] {
+			return uint32ToIP(value)
+		}
+	}
+
+	return nil
+}
+
+func (d *DHCPServer) handle(packet []byte) []byte {
+	if len(packet) < dhcpHeaderLength+4 || packet[0] != 1 || binary.BigEndian.Uint32(packet[dhcpHeaderLength:]) != dhcpMagicCookie {
+		return nil
+	}
+
+	options := parseDHCPOptions(packet[dhcpHeaderLength+4:])
+	messageType, ok := options[dhcpOptionMessageType]
+	if !ok || len(messageType) != 1 {
+		return nil
+	}
+
+	mac := net.HardwareAddr(packet[28:34]).String()
+	var requested net.IP
+	if value, ok := options[dhcpOptionRequestedIP]; ok && len(value) == 4 {
+		requested = net.IP(value)
+	} else if ciaddr := net.IP(packet[12:16]); !ciaddr.Equal(net.IPv4zero) {
+		requested = ciaddr
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	switch messageType[0] {
+	case dhcpDiscover:
+		ip := d.allocate(mac, requested)
+		if ip == nil {
+			zap.S().Warnf("dhcp range on %s is full, ignoring %s", d.interfaceName, mac)
+			return nil
+		}
+		d.offers[mac] = DHCPLease{MAC: mac, IP: ip.String(), Expiry: time.Now().Add(dhcpOfferTimeout)}
+		return d.reply(packet, dhcpOffer, ip)
+	case dhcpRequest:
+		// A request meant for another server on the segment isn't ours to answer
+		if serverId, ok := options[dhcpOptionServerId]; ok && !net.IP(serverId).Equal(d.serverIP) {
+			return nil
+		}
+		ip := d.allocate(mac, requested)
+		if ip == nil || (requested != nil && !ip.Equal(requested)) {
+			return d.reply(packet, dhcpNak, net.IPv4zero.To4())
+		}
+		delete(d.offers, mac)
+		d.leases[mac] = DHCPLease{MAC: mac, IP: ip.String(), Expiry: time.Now().Add(d.leaseTime)}
+		return d.reply(packet, dhcpAck, ip)
+	case dhcpDecline:
+		// The client found the address taken, handing it out again would only repeat that
+		declined := requested
+		if lease, ok := d.leases[mac]; ok && declined == nil {
+			declined = net.ParseIP(lease.IP)
+		}
+		if declined != nil {
+			zap.S().Warnf("%s declined %s on %s, holding it back", mac, declined, d.interfaceName)
+			d.declined[declined.String()] = time.Now().Add(dhcpDeclineHoldDown)
+		}
+		delete(d.offers, mac)
+		delete(d.leases, mac)
+	case dhcpRelease:
+		delete(d.offers, mac)
+		delete(d.leases, mac)
+	}
+
+	return nil
+}
+
+func (d *DHCPServer) reply(request []byte, messageType byte, ip net.IP) []byte {
+	reply := make([]byte, dhcpHeaderLength+4)
+	reply[0] = 2 // boot reply
+	reply[1] = request[1]
+	reply[2] = request[2]
+	copy(reply[4:8], request[4:8]) // transaction id
+	binary.BigEndian.PutUint16(reply[10:], dhcpBroadcastFlag)
+	copy(reply[16:20], ip.To4())
+	copy(reply[20:24], d.serverIP)
+	copy(reply[24:28], request[24:28]) // relay agent
+	copy(reply[28:44], request[28:44]) // client hardware address
+	binary.BigEndian.PutUint32(reply[dhcpHeaderLength:], dhcpMagicCookie)
+
+	options := bytes.Buffer{}
+	addOption := func(code byte, value []byte) {
+		options.WriteByte(code)
+		options.WriteByte(byte(len(value)))
+		options.Write(value)
+	}
+
+	addOption(dhcpOptionMessageType, []byte{messageType})
+	addOption(dhcpOptionServerId, d.serverIP)
+
+	if messageType != dhcpNak {
+		leaseTime := make([]byte, 4)
+		binary.BigEndian.PutUint32(leaseTime, uint32(d.leaseTime.Seconds()))
+		addOption(dhcpOptionLeaseTime, leaseTime)
+		addOption(dhcpOptionSubnetMask, d.network.Mask)
+		addOption(dhcpOptionRouter, d.serverIP)
+
+		dns := []byte{}
+		for _, server := range d.dns {
+			dns = append(dns, server...)
+		}
+		addOption(dhcpOptionDNS, dns)
+	}
+	options.WriteByte(dhcpOptionEnd)
+
+	reply = append(reply, options.Bytes()...)
+	for len(reply) < dhcpMinimumPacketLength {
+		reply = append(reply, dhcpOptionPad)
+	}
+
+	return reply
+}
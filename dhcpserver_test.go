@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func dhcpTestPacket(messageType byte, mac string, requested string, serverId string) []byte {
+	packet := make([]byte, dhcpHeaderLength+4)
+	packet[0] = 1 // boot request
+	packet[1] = 1 // ethernet
+	packet[2] = 6
+	hardwareAddr, _ := net.ParseMAC(mac)
+	copy(packet[28:], hardwareAddr)
+	binary.BigEndian.PutUint32(packet[dhcpHeaderLength:], dhcpMagicCookie)
+
+	packet = append(packet, dhcpOptionMessageType, 1, messageType)
+	if requested != "" {
+		packet = append(append(packet, dhcpOptionRequestedIP, 4), net.ParseIP(requested).To4()...)
+	}
+	if serverId != "" {
+		packet = append(append(packet, dhcpOptionServerId, 4), net.ParseIP(serverId).To4()...)
+	}
+	return append(packet, dhcpOptionEnd)
+}
+
+// dhcpTestReply gives the message type and address of a reply, 0 and "" for none
+func dhcpTestReply(reply []byte) (byte, string) {
+	if reply == nil {
+		return 0, ""
+	}
+
+	options := parseDHCPOptions(reply[dhcpHeaderLength+4:])
+	return options[dhcpOptionMessageType][0], net.IP(reply[16:20]).String()
+}
+
+func TestDHCPServerLeases(t *testing.T) {
+	server, err := newDHCPServer(RouterConfig{LanInterface: "lan0", LanAddress: "192.168.8.1/24",
+		DHCPRangeStart: "192.168.8.100", DHCPRangeEnd: "192.168.8.103", DHCPLeaseTime: 3600})
+	if err != nil {
+		t.Fatalf("unable to create dhcp server, error: %v", err)
+	}
+
+	const (
+		first  = "02:00:00:00:00:01"
+		second = "02:00:00:00:00:02"
+	)
+
+	steps := []struct {
+		name        string
+		packet      []byte
+		wantType    byte
+		wantAddress string
+	}{
+		{"first discovers", dhcpTestPacket(dhcpDiscover, first, "", ""), dhcpOffer, "192.168.8.100"},
+		// The offer to the first client is held, the second gets the next address
+		{"second discovers", dhcpTestPacket(dhcpDiscover, second, "", ""), dhcpOffer, "192.168.8.101"},
+		{"second asks for the first offer", dhcpTestPacket(dhcpRequest, second, "192.168.8.100", ""), dhcpNak, "0.0.0.0"},
+		{"first requests its offer", dhcpTestPacket(dhcpRequest, first, "192.168.8.100", "192.168.8.1"), dhcpAck, "192.168.8.100"},
+		{"request for another server", dhcpTestPacket(dhcpRequest, second, "192.168.8.101", "192.168.8.254"), 0, ""},
+		{"second requests its offer", dhcpTestPacket(dhcpRequest, second, "192.168.8.101", "192.168.8.1"), dhcpAck, "192.168.8.101"},
+		{"first renews", dhcpTestPacket(dhcpRequest, first, "192.168.8.100", ""), dhcpAck, "192.168.8.100"},
+		// The address turned out to be in use, it isn't offered again
+		{"first declines", dhcpTestPacket(dhcpDecline, first, "192.168.8.100", "192.168.8.1"), 0, ""},
+		{"first discovers again", dhcpTestPacket(dhcpDiscover, first, "192.168.8.100", ""), dhcpOffer, "192.168.8.102"},
+		{"second releases", dhcpTestPacket(dhcpRelease, second, "", "192.168.8.1"), 0, ""},
+		{"released address is free", dhcpTestPacket(dhcpDiscover, "02:00:00:00:00:03", "", ""), dhcpOffer, "192.168.8.101"},
+		{"last address", dhcpTestPacket(dhcpDiscover, "02:00:00:00:00:04", "", ""), dhcpOffer, "192.168.8.103"},
+		{"range full", dhcpTestPacket(dhcpDiscover, "02:00:00:00:00:05", "", ""), 0, ""},
+	}
+
+	for _, step := range steps {
+		messageType, address := dhcpTestReply(server.handle(step.packet))
+		if messageType != step.wantType || address != step.wantAddress {
+			t.Errorf("%s: got type %d with %s, want type %d with %s",
+				step.name, messageType, address, step.wantType, step.wantAddress)
+		}
+	}
+
+	// Offers and the decline hold-down run out
+	expired := time.Now().Add(-time.Second)
+	for mac, offer := range server.offers {
+		offer.Expiry = expired
+		server.offers[mac] = offer
+	}
+	for ip := range server.declined {
+		server.declined[ip] = expired
+	}
+
+	messageType, address := dhcpTestReply(server.handle(dhcpTestPacket(dhcpDiscover, "02:00:00:00:00:05", "", "")))
+	if messageType != dhcpOffer || address != "192.168.8.100" {
+		t.Errorf("after hold-down got type %d with %s, want an offer of 192.168.8.100", messageType, address)
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+)
+
+type EthernetStatus struct {
+	Interface         string
+	Carrier           bool
+	CarrierChanges    int
+	LastCarrierChange time.Time
+	Address           string
+	LeaseExpiry       time.Time // zero when the address doesn't expire, e.g. static or dhclient
+	Gateway           string
+	GatewayReachable  bool
+	// Carrier is up but the gateway doesn't answer ARP, usually a dead switch port or upstream
+	Degraded bool
+}
+
+type EthernetMonitor struct {
+	mutex    sync.Mutex
+	status   EthernetStatus
+	watching sync.Once
+}
+
+var ethernetMonitor EthernetMonitor
+
+func (e *EthernetMonitor) Status() EthernetStatus {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.status
+}
+
+func (e *EthernetMonitor) setCarrier(carrier bool) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if e.status.Carrier == carrier && !e.status.LastCarrierChange.IsZero() {
+		return
+	}
+
+	if !e.status.LastCarrierChange.IsZero() {
+		e.status.CarrierChanges++
+		if carrier {
+			zap.S().Infof("carrier on %s is back", Config.EthernetInterface)
+		} else {
+			zap.S().Warnf("carrier on %s lost", Config.EthernetInterface)
+		}
+	}
+
+	e.status.Carrier = carrier
+	e.status.LastCarrierChange = time.Now()
+}
+
+// WatchCarrier follows link notifications from the kernel so carrier flaps between two
+// checks are still counted. It runs for the life of the daemon.
+func (e *EthernetMonitor) WatchCarrier() {
+	for {
+		err := e.watchCarrier()
+		zap.S().Errorf("stopped watching carrier on %s, error: %v", Config.EthernetInterface, err)
+		time.Sleep(10 * time.Second)
+	}
+}
+
+func (e *EthernetMonitor) watchCarrier() error {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	err = syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: unix.RTMGRP_LINK})
+	if err != nil {
+		return err
+	}
+
+	// Start from the current state, events only tell us about changes
+	state, err := getInterfaceState(Config.EthernetInterface)
+	if err == nil {
+		e.setCarrier(state.Up && state.Carrier)
+	}
+
+	buffer := make([]byte, 65536)
+	for {
+		length, _, err := syscall.Recvfrom(fd, buffer, 0)
+		if err != nil {
+			return err
+		}
+
+		messages, err := syscall.ParseNetlinkMessage(buffer[:length])
+		if err != nil {
+			continue
+		}
+
+		for _, message := range messages {
+			if message.Header.Type != syscall.RTM_NEWLINK || len(message.Data) < syscall.SizeofIfInfomsg {
+				continue
+			}
+
+			info := (*syscall.IfInfomsg)(unsafe.Pointer(&message.Data[0]))
+			attributes, err := syscall.ParseNetlinkRouteAttr(&message)
+			if err != nil {
+				continue
+			}
+
+			name := ""
+			carrier := false
+			for _, attribute := range attributes {
+				switch attribute.Attr.Type {
+				case syscall.IFLA_IFNAME:
+					name = cString(attribute.Value)
+				case unix.IFLA_CARRIER:
+					carrier = len(attribute.Value) > 0 && attribute.Value[0] == 1
+				}
+			}
+
+			if name == Config.EthernetInterface {
+				e.setCarrier(info.Flags&syscall.IFF_UP != 0 && carrier)
+			}
+		}
+	}
+}
+
+// arpPing asks who has the target address on the link and waits for the answer. Unlike ICMP
+// this works even when the gateway filters pings, and it doesn't depend on any routing.
+func arpPing(interfaceName string, source net.IP, target net.IP, timeout time.Duration) error {
+	networkInterface, err := net.InterfaceByName(interfaceName)
+	if err != nil {
+		return err
+	}
+
+	if len(networkInterface.HardwareAddr) != 6 || source.To4() == nil || target.To4() == nil {
+		return fmt.Errorf("arp needs an ethernet interface and ipv4 addresses")
+	}
+
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, int(htons(unix.ETH_P_ARP)))
+	if err != nil {
+		return fmt.Errorf("unable to open packet socket, the daemon needs CAP_NET_RAW, error: %v", err)
+	}
+	defer unix.Close(fd)
+
+	linkAddress := &unix.SockaddrLinklayer{
+		Protocol: htons(unix.ETH_P_ARP),
+		Ifindex:  networkInterface.Index,
+		Halen:    6,
+	}
+	copy(linkAddress.Addr[:], []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+
+	err = unix.Bind(fd, &unix.SockaddrLinklayer{Protocol: htons(unix.ETH_P_ARP), Ifindex: networkInterface.Index})
+	if err != nil {
+		return err
+	}
+
+	request := make([]byte, 28)
+	binary.BigEndian.PutUint16(request[0:], 1)      // ethernet
+	binary.BigEndian.PutUint16(request[2:], 0x0800) // ipv4
+	request[4] = 6
+	request[5] = 4
+	binary.BigEndian.PutUint16(request[6:], 1) // request
+	copy(request[8:], networkInterface.HardwareAddr)
+	copy(request[14:], source.To4())
+	copy(request[24:], target.To4())
+
+	err = unix.Sendto(fd, request, 0, linkAddress)
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(timeout)
+	buffer := make([]byte, 128)
+	for {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return fmt.Errorf("no arp reply from %s", target)
+		}
+
+		timeval := unix.NsecToTimeval(remaining.Nanoseconds())
+		err = unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &timeval)
+		if err != nil {
+			return err
+		}
+
+		length, _, err := unix.Recvfrom(fd, buffer, 0)
+		if errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EINTR) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		reply := buffer[:length]
+		if length >= 28 && binary.BigEndian.Uint16(reply[6:]) == 2 && bytes.Equal(reply[14:18], target.To4()) {
+			return nil
+		}
+	}
+}
+
+func htons(value uint16) uint16 {
+	return value<<8 | value>>8
+}
+
+// Update reads the lease from the address the DHCP client installed and checks the gateway
+// still answers on the link.
+func (e *EthernetMonitor) Update() {
+	e.watching.Do(func() {
+		go e.WatchCarrier()
+	})
+
+	interfaceName := Config.EthernetInterface
+	state, err := getInterfaceState(interfaceName)
+	if err != nil {
+		zap.S().Debugf("unable to read %s state, error: %v", interfaceName, err)
+	}
+
+	status := EthernetStatus{Interface: interfaceName}
+
+	addresses := state.GlobalAddresses(false)
+	var source net.IP
+	if len(addresses) > 0 {
+		source = addresses[0].IP
+		status.Address = addresses[0].String()
+		if lifetime, ok := state.AddressLifetimes[source.String()]; ok {
+			status.LeaseExpiry = time.Now().Add(lifetime).Round(time.Second)
+		}
+	}
+
+	var gateway net.IP
+	for _, route := range state.Routes {
+		if route.IsDefault() && route.Table == syscall.RT_TABLE_MAIN && route.Gateway.To4() != nil {
+			gateway = route.Gateway
+			status.Gateway = gateway.String()
+			break
+		}
+	}
+
+	carrier := state.Up && state.Carrier
+	if carrier && source != nil && gateway != nil {
+		err = arpPing(interfaceName, source, gateway, time.Duration(Config.ArpTimeout)*time.Second)
+		if err != nil {
+			zap.S().Warnf("gateway %s on %s doesn't answer arp, error: %v", gateway, interfaceName, err)
+		}
+		status.GatewayReachable = err == nil
+	}
+	status.Degraded = carrier && gateway != nil && !status.GatewayReachable
+
+	// Polling catches what the watcher may have missed while it was reconnecting
+	e.setCarrier(carrier)
+
+	e.mutex.Lock()
+	status.Carrier = e.status.Carrier
+	status.CarrierChanges = e.status.CarrierChanges
+	status.LastCarrierChange = e.status.LastCarrierChange
+	e.status = status
+	e.mutex.Unlock()
+}
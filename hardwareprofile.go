@@ -33,6 +33,8 @@ type Profile struct {
 	Hostname        string
 	Platform        string
 	Board           string
+	// ntp or nitz, whichever last set the system clock
+	TimeSource string
 }
 
 var modems = [...]VendorModem{
@@ -122,6 +124,9 @@ func GetHardwareProfile() (*Profile, error) {
 		return nil, err
 	}
 
+	// Not something identified here, it is kept from the saved profile
+	hardwareProfile.TimeSource = oldHardwareProfile.TimeSource
+
 	zap.S().Info("")
 	zap.S().Info("=============================================================")
 	zap.S().Info("[?] Hardware Profile Report")
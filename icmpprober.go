@@ -0,0 +1,300 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+)
+
+type ProbeResult struct {
+	Target   string
+	Sent     int
+	Received int
+	Loss     float64 // percent
+	MinRTT   float64 // milliseconds, same for the rest
+	AvgRTT   float64
+	MaxRTT   float64
+	Jitter   float64
+}
+
+type icmpSocket struct {
+	fd    int
+	ipv6  bool
+	raw   bool
+	ident uint16
+}
+
+// openIcmpSocket prefers the unprivileged ping socket (needs the group in
+// net.ipv4.ping_group_range) and falls back to a raw socket, which needs CAP_NET_RAW.
+// Either way the socket is bound to the interface so the probe can't leak out another uplink.
+func openIcmpSocket(interfaceName string, ipv6 bool) (*icmpSocket, error) {
+	family, protocol := unix.AF_INET, unix.IPPROTO_ICMP
+	if ipv6 {
+		family, protocol = unix.AF_INET6, unix.IPPROTO_ICMPV6
+	}
+
+	socket := &icmpSocket{ipv6: ipv6, ident: uint16(os.Getpid())}
+
+	fd, err := unix.Socket(family, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, protocol)
+	if err != nil {
+		fd, err = unix.Socket(family, unix.SOCK_RAW|unix.SOCK_CLOEXEC, protocol)
+		if err != nil {
+			return nil, fmt.Errorf("unable to open icmp socket, the daemon needs CAP_NET_RAW or ping_group_range, error: %v", err)
+		}
+		socket.raw = true
+	}
+	socket.fd = fd
+
+	err = unix.BindToDevice(fd, interfaceName)
+	if err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("unable to bind icmp socket to %s, error: %v", interfaceName, err)
+	}
+
+	return socket, nil
+}
+
+func (s *icmpSocket) Close() {
+	unix.Close(s.fd)
+}
+
+func icmpChecksum(data []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(data[i])<<8 | uint32(data[i+1])
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+
+	return ^uint16(sum)
+}
+
+// echoRequest builds a request of size bytes, ICMP header included. The payload starts with
+// the send time, the rest is padding.
+func (s *icmpSocket) echoRequest(sequence uint16, size int) []byte {
+	if size < 16 {
+		size = 16
+	}
+	packet := make([]byte, size)
+	packet[0] = 8
+	if s.ipv6 {
+		packet[0] = 128
+	}
+	binary.BigEndian.PutUint16(packet[4:], s.ident)
+	binary.BigEndian.PutUint16(packet[6:], sequence)
+	binary.BigEndian.PutUint64(packet[8:], uint64(time.Now().UnixNano()))
+
+	// The kernel fills the checksum in for ping sockets and for ICMPv6
+	if s.raw && !s.ipv6 {
+		binary.BigEndian.PutUint16(packet[2:], icmpChecksum(packet))
+	}
+
+	return packet
+}
+
+// isEchoReply checks a received packet is the answer to our request. Raw IPv4 sockets hand us
+// the IP header too, and on ping sockets the kernel owns the identifier so only the sequence
+// can be compared.
+func (s *icmpSocket) isEchoReply(packet []byte, sequence uint16) bool {
+	if s.raw && !s.ipv6 {
+		if len(packet) < 20 {
+			return false
+		}
+		packet = packet[int(packet[0]&0x0f)*4:]
+	}
+
+	if len(packet) < 8 {
+		return false
+	}
+
+	replyType := byte(0)
+	if s.ipv6 {
+		replyType = 129
+	}
+
+	if packet[0] != replyType || binary.BigEndian.Uint16(packet[6:]) != sequence {
+		return false
+	}
+
+	return !s.raw || binary.BigEndian.Uint16(packet[4:]) == s.ident
+}
+
+func (s *icmpSocket) ping(target net.IP, sequence uint16, timeout time.Duration) (time.Duration, error) {
+	return s.pingSize(target, sequence, 16, timeout)
+}
+
+func (s *icmpSocket) pingSize(target net.IP, sequence uint16, size int, timeout time.Duration) (time.Duration, error) {
+	var address unix.Sockaddr
+	if s.ipv6 {
+		sockaddr := &unix.SockaddrInet6{}
+		copy(sockaddr.Addr[:], target.To16())
+		address = sockaddr
+	} else {
+		sockaddr := &unix.SockaddrInet4{}
+		copy(sockaddr.Addr[:], target.To4())
+		address = sockaddr
+	}
+
+	start := time.Now()
+	err := unix.Sendto(s.fd, s.echoRequest(sequence, size), 0, address)
+	if err != nil {
+		return 0, err
+	}
+
+	deadline := start.Add(timeout)
+	buffer := make([]byte, 65536)
+	for {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return 0, fmt.Errorf("no reply from %s", target)
+		}
+
+		timeval := unix.NsecToTimeval(remaining.Nanoseconds())
+		err = unix.SetsockoptTimeval(s.fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &timeval)
+		if err != nil {
+			return 0, err
+		}
+
+		length, from, err := unix.Recvfrom(s.fd, buffer, 0)
+		if errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EINTR) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		// Raw sockets see every echo reply on the host, including the ones for the other
+		// targets we are probing at the same time with the same identifier
+		if !sockaddrIP(from).Equal(target) {
+			continue
+		}
+
+		if s.isEchoReply(buffer[:length], sequence) {
+			return time.Since(start), nil
+		}
+	}
+}
+
+func sockaddrIP(address unix.Sockaddr) net.IP {
+	switch sockaddr := address.(type) {
+	case *unix.SockaddrInet4:
+		return net.IP(sockaddr.Addr[:])
+	case *unix.SockaddrInet6:
+		return net.IP(sockaddr.Addr[:])
+	}
+
+	return nil
+}
+
+// summarizeProbes works out loss, round trips and jitter. Without a reply there is no round
+// trip to report, the RTT fields and jitter stay zero rather than NaN or infinity and the loss
+// is total.
+func summarizeProbes(target string, sent int, rtts []float64) ProbeResult {
+	result := ProbeResult{Target: target, Sent: sent, Received: len(rtts)}
+	if len(rtts) == 0 {
+		result.Loss = 100
+		return result
+	}
+
+	if sent > 0 {
+		result.Loss = 100 * float64(sent-len(rtts)) / float64(sent)
+	}
+
+	result.MinRTT = math.Inf(1)
+	sum := 0.0
+	for i, rtt := range rtts {
+		sum += rtt
+		result.MinRTT = math.Min(result.MinRTT, rtt)
+		result.MaxRTT = math.Max(result.MaxRTT, rtt)
+		// Jitter as the mean difference between consecutive round trips, like RFC 3550
+		if i > 0 {
+			result.Jitter += math.Abs(rtt - rtts[i-1])
+		}
+	}
+	result.AvgRTT = sum / float64(len(rtts))
+	if len(rtts) > 1 {
+		result.Jitter /= float64(len(rtts) - 1)
+	}
+
+	return result
+}
+
+// probeTarget sends count echo requests to one target out of the interface
+func probeTarget(interfaceName string, target string, count int, timeout time.Duration) (ProbeResult, error) {
+	ip := net.ParseIP(target)
+	if ip == nil {
+		addresses, err := net.LookupIP(target)
+		if err != nil || len(addresses) == 0 {
+			return summarizeProbes(target, 0, nil), fmt.Errorf("unable to resolve probe target %s, error: %v", target, err)
+		}
+		ip = addresses[0]
+	}
+
+	socket, err := openIcmpSocket(interfaceName, ip.To4() == nil)
+	if err != nil {
+		return summarizeProbes(target, 0, nil), err
+	}
+	defer socket.Close()
+
+	rtts := []float64{}
+	for sequence := 1; sequence <= count; sequence++ {
+		rtt, err := socket.ping(ip, uint16(sequence), timeout)
+		if err == nil {
+			rtts = append(rtts, float64(rtt.Microseconds())/1000)
+		}
+
+		if sequence < count {
+			time.Sleep(time.Duration(Config.ProbeInterval) * time.Millisecond)
+		}
+	}
+
+	return summarizeProbes(target, count, rtts), nil
+}
+
+// probeTargets probes every target at the same time so a dead link costs one timeout rather
+// than one per target, and calls the link healthy when enough targets answered.
+func probeTargets(interfaceName string, targets []string, count int, quorum int, timeout time.Duration) ([]ProbeResult, bool) {
+	results := make([]ProbeResult, len(targets))
+	var wait sync.WaitGroup
+
+	for i, target := range targets {
+		wait.Add(1)
+		go func(i int, target string) {
+			defer wait.Done()
+			result, err := probeTarget(interfaceName, target, count, timeout)
+			if err != nil {
+				zap.S().Debugf("probe to %s over %s failed, error: %v", target, interfaceName, err)
+			}
+			results[i] = result
+		}(i, target)
+	}
+	wait.Wait()
+
+	if quorum > len(targets) {
+		quorum = len(targets)
+	}
+	if quorum < 1 {
+		quorum = 1
+	}
+
+	answered := 0
+	for _, result := range results {
+		if result.Received > 0 {
+			answered++
+		}
+	}
+
+	return results, len(targets) > 0 && answered >= quorum
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestSummarizeProbes(t *testing.T) {
+	tests := []struct {
+		name string
+		sent int
+		rtts []float64
+		want ProbeResult
+	}{
+		{"no replies", 3, nil, ProbeResult{Sent: 3, Loss: 100}},
+		// The target couldn't even be resolved
+		{"nothing sent", 0, nil, ProbeResult{Loss: 100}},
+		{"one reply", 3, []float64{20}, ProbeResult{Sent: 3, Received: 1, Loss: 200.0 / 3, MinRTT: 20, AvgRTT: 20, MaxRTT: 20}},
+		{"all replies", 3, []float64{20, 30, 10}, ProbeResult{Sent: 3, Received: 3, MinRTT: 10, AvgRTT: 20, MaxRTT: 30, Jitter: 15}},
+	}
+
+	for _, test := range tests {
+		got := summarizeProbes("192.0.2.1", test.sent, test.rtts)
+		test.want.Target = "192.0.2.1"
+		for _, value := range []float64{got.Loss, got.MinRTT, got.AvgRTT, got.MaxRTT, got.Jitter} {
+			if math.IsNaN(value) || math.IsInf(value, 0) {
+				t.Errorf("%s: %+v holds NaN or infinity", test.name, got)
+			}
+		}
+		if got != test.want {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
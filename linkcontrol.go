@@ -0,0 +1,226 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"go.uber.org/zap"
+)
+
+// Link changes used to go through `sudo ip link`, they now go over rtnetlink from the daemon
+// itself which only needs CAP_NET_ADMIN instead of a sudoers entry on every image.
+func linkControlError(action string, interfaceName string, err error) error {
+	if errors.Is(err, syscall.EPERM) {
+		return fmt.Errorf("unable to %s %s, the daemon needs CAP_NET_ADMIN, error: %v", action, interfaceName, err)
+	}
+
+	return fmt.Errorf("unable to %s %s, error: %v", action, interfaceName, err)
+}
+
+func setLinkState(interfaceName string, up bool) error {
+	state, err := getInterfaceState(interfaceName)
+	if err != nil {
+		return err
+	}
+
+	info := syscall.IfInfomsg{
+		Family: syscall.AF_UNSPEC,
+		Index:  int32(state.Index),
+		Change: syscall.IFF_UP,
+	}
+	if up {
+		info.Flags = syscall.IFF_UP
+	}
+
+	payload := structBytes(unsafe.Pointer(&info), syscall.SizeofIfInfomsg)
+	_, err = netlinkExecute(syscall.NETLINK_ROUTE, syscall.RTM_NEWLINK, 0, payload)
+	return err
+}
+
+func setLinkUp(interfaceName string) error {
+	err := setLinkState(interfaceName, true)
+	if err != nil {
+		return linkControlError("bring up", interfaceName, err)
+	}
+
+	return nil
+}
+
+func setLinkDown(interfaceName string) error {
+	err := setLinkState(interfaceName, false)
+	if err != nil {
+		return linkControlError("bring down", interfaceName, err)
+	}
+
+	return nil
+}
+
+func setLinkMTU(interfaceName string, mtu int) error {
+	state, err := getInterfaceState(interfaceName)
+	if err != nil {
+		return err
+	}
+
+	info := syscall.IfInfomsg{Family: syscall.AF_UNSPEC, Index: int32(state.Index)}
+	payload := structBytes(unsafe.Pointer(&info), syscall.SizeofIfInfomsg)
+	payload = append(payload, netlinkAttribute(syscall.IFLA_MTU, nativeUint32Bytes(uint32(mtu)))...)
+
+	_, err = netlinkExecute(syscall.NETLINK_ROUTE, syscall.RTM_NEWLINK, 0, payload)
+	if err != nil {
+		return linkControlError(fmt.Sprintf("set mtu %d on", mtu), interfaceName, err)
+	}
+
+	return nil
+}
+
+// flushAddresses removes every address except IPv6 link-local ones, which the kernel puts
+// straight back and which DHCP has nothing to do with.
+func flushAddresses(interfaceName string) error {
+	state, err := getInterfaceState(interfaceName)
+	if err != nil {
+		return linkControlError("flush addresses on", interfaceName, err)
+	}
+
+	for _, address := range state.Addresses {
+		if address.IP.IsLinkLocalUnicast() {
+			continue
+		}
+
+		family := syscall.AF_INET6
+		ip := address.IP.To16()
+		if ipv4 := address.IP.To4(); ipv4 != nil {
+			family = syscall.AF_INET
+			ip = ipv4
+		}
+
+		prefixLength, _ := address.Mask.Size()
+		info := syscall.IfAddrmsg{
+			Family:    uint8(family),
+			Prefixlen: uint8(prefixLength),
+			Index:     uint32(state.Index),
+		}
+
+		payload := structBytes(unsafe.Pointer(&info), syscall.SizeofIfAddrmsg)
+		payload = append(payload, netlinkAttribute(syscall.IFA_LOCAL, ip)...)
+		payload = append(payload, netlinkAttribute(syscall.IFA_ADDRESS, ip)...)
+
+		_, err = netlinkExecute(syscall.NETLINK_ROUTE, syscall.RTM_DELADDR, 0, payload)
+		if err != nil && !errors.Is(err, syscall.EADDRNOTAVAIL) {
+			return linkControlError("flush addresses on", interfaceName, err)
+		}
+	}
+
+	return nil
+}
+
+// waitForInterface polls the kernel until the interface satisfies the condition or the timeout
+// runs out.
+func waitForInterface(interfaceName string, timeout time.Duration, condition func(InterfaceState) bool) error {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		state, err := getInterfaceState(interfaceName)
+		if err != nil && !errors.Is(err, errInterfaceNotFound) {
+			return err
+		}
+
+		if err == nil && condition(state) {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out after %v waiting for %s", timeout, interfaceName)
+		}
+
+		time.Sleep(250 * time.Millisecond)
+	}
+}
+
+func waitForCarrier(interfaceName string, timeout time.Duration) error {
+	return waitForInterface(interfaceName, timeout, func(state InterfaceState) bool {
+		return state.Up && state.Carrier
+	})
+}
+
+func waitForLinkDown(interfaceName string, timeout time.Duration) error {
+	return waitForInterface(interfaceName, timeout, func(state InterfaceState) bool {
+		return !state.Up
+	})
+}
+
+// bounceInterface takes the link down, clears its addresses and brings it back up. dhcpcd,
+// dhclient and systemd-networkd all start a fresh DHCP exchange when carrier comes back with
+// no address on the link, so this doubles as the DHCP renewal trigger.
+func bounceInterface(interfaceName string, timeout time.Duration) error {
+	err := setLinkDown(interfaceName)
+	if err != nil {
+		return err
+	}
+
+	err = waitForLinkDown(interfaceName, timeout)
+	if err != nil {
+		return err
+	}
+	zap.S().Infof("interface %s is down", interfaceName)
+
+	err = flushAddresses(interfaceName)
+	if err != nil {
+		return err
+	}
+
+	err = setLinkUp(interfaceName)
+	if err != nil {
+		return err
+	}
+
+	err = waitForCarrier(interfaceName, timeout)
+	if err != nil {
+		return fmt.Errorf("no carrier on %s after bringing it up, error: %v", interfaceName, err)
+	}
+	zap.S().Infof("interface %s is up", interfaceName)
+
+	return nil
+}
+
+// addAddress puts the address on the interface, leaving it alone if it is already there
+func addAddress(interfaceName string, address net.IPNet) error {
+	state, err := getInterfaceState(interfaceName)
+	if err != nil {
+		return linkControlError("add address to", interfaceName, err)
+	}
+
+	for _, existing := range state.Addresses {
+		if existing.String() == address.String() {
+			return nil
+		}
+	}
+
+	family := syscall.AF_INET6
+	ip := address.IP.To16()
+	if ipv4 := address.IP.To4(); ipv4 != nil {
+		family = syscall.AF_INET
+		ip = ipv4
+	}
+
+	prefixLength, _ := address.Mask.Size()
+	info := syscall.IfAddrmsg{
+		Family:    uint8(family),
+		Prefixlen: uint8(prefixLength),
+		Index:     uint32(state.Index),
+	}
+
+	payload := structBytes(unsafe.Pointer(&info), syscall.SizeofIfAddrmsg)
+	payload = append(payload, netlinkAttribute(syscall.IFA_LOCAL, ip)...)
+	payload = append(payload, netlinkAttribute(syscall.IFA_ADDRESS, ip)...)
+
+	_, err = netlinkExecute(syscall.NETLINK_ROUTE, syscall.RTM_NEWADDR, syscall.NLM_F_CREATE|syscall.NLM_F_REPLACE, payload)
+	if err != nil {
+		return linkControlError("add address to", interfaceName, err)
+	}
+
+	return nil
+}
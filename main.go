@@ -28,6 +28,11 @@ func main() {
 	undo := zap.ReplaceGlobals(logger)
 	defer undo()
 
+	state, err = loadState()
+	if err != nil {
+		zap.S().Errorf("unable to load state.yaml, error: %v", err)
+	}
+
 }
 
 func manageConnections() {
@@ -0,0 +1,25 @@
+package main
+
+import "go.uber.org/zap"
+
+var meteredRestriction = TrafficRestriction{table: "cm_metered"}
+
+// isMeteredInterface tells whether data on the interface costs, the cellular ones once
+// MeteredPolicy is on
+func isMeteredInterface(interfaceName string) bool {
+	return Config.MeteredPolicy && isCellularInterface(interfaceName)
+}
+
+// ManageMeteredPolicy limits the cellular uplink to AllowedDestinations while it carries the
+// traffic, and lifts the limit as soon as a non-metered uplink from NetworkPriority takes over.
+func ManageMeteredPolicy(uplink string) {
+	restricted := []string{}
+	if uplink != "" && isMeteredInterface(uplink) {
+		restricted = append(restricted, uplink)
+	}
+
+	err := meteredRestriction.Apply(restricted)
+	if err != nil {
+		zap.S().Errorf("unable to apply metered link policy, error: %v", err)
+	}
+}
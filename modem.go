@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"strconv"
@@ -24,6 +25,18 @@ type DiagnosticProperties struct {
 	SimReady        bool
 	ModemMode       bool
 	ModemApn        bool
+	PDPAddressMatch bool
+	PDPAddressError string
+	IPv6Address     bool
+	IPv6Route       bool
+	FailedLayer     string
+	CaptivePortal   bool
+	InterfaceMTU    int
+	PathMTU         int // 0 when it couldn't be measured
+	PathMTUApplied  bool
+	Traceroute      []TracerouteHop
+	DNSResults      []DNSCheckResult
+	CellLock        CellLockStatus
 	Timestamp       time.Time
 }
 
@@ -43,6 +56,27 @@ type MonitoringProperties struct {
 	CellularConnection bool
 	CellularLatency    int
 	FixedIncident      int
+	ActiveAPN          string
+	PDPContexts        map[string]PDPContextStatus
+	// Per address family results, CellularConnection is true if either works
+	CellularIPv4Connection bool
+	CellularIPv4Latency    int
+	CellularIPv6Connection bool
+	CellularIPv6Latency    int
+	CellularProbes         []ProbeResult
+	CellularChecks         []CheckOutcome
+	CellularAddresses      []string
+	CellularGateway        string
+	CellularDNS            []string
+	ActiveUplink           string
+	Uplinks                map[string]UplinkStatus
+	Wifi                   WifiStatus
+	Ethernet               EthernetStatus
+	WireGuard              WireGuardStatus
+	Keepalives             map[string]KeepaliveStatus
+	DataUsage              map[string]DataUsageStatus
+	ThroughputHistory      []ThroughputResult
+	LastCapture            CaptureResult
 }
 
 type Modem struct {
@@ -63,6 +97,9 @@ type Modem struct {
 	PDPStatusCommand     string
 	IncidentFlag         bool
 	DiagnosticProperties DiagnosticProperties
+	ApnLadder            []string
+	ApnIndex             int
+	MultipleContexts     bool
 }
 
 func (m *Modem) Initialize() {
@@ -90,23 +127,27 @@ func updateModemCommands(vendor, model string, modem *Modem) {
 		modem.InterfaceName = "usb0"
 		modem.ModeStatusCommand = "AT+QCFG=\"usbnet\""
 		modem.RebootCommand = "AT+CFUN=1,1"
-		modem.PDPActivateCommand = "AT"
+		modem.PDPActivateCommand = "AT+QNETDEVCTL=1,%d,1"
 		modem.PDPStatusCommand = "AT+CGACT?"
 		modem.EcmModeSetterCommand = "AT+QCFG=\"usbnet\",1"
 		modem.EcmModeResponse = "\"usbnet\",1"
+		modem.MultipleContexts = true
 	} else if vendor == "Telit" {
 		modem.InterfaceName = "wwan0"
 		modem.ModeStatusCommand = "AT#USBCFG?"
 		modem.RebootCommand = "AT#REBOOT"
-		modem.PDPActivateCommand = "AT#ECM=1,0"
+		// #ECM=<instance>,<cid>, the modems have the one instance 0
+		modem.PDPActivateCommand = "AT#ECM=0,%d"
 		modem.PDPStatusCommand = "AT#ECM?"
 
 		if model == "ME910C1-WW" {
 			modem.EcmModeSetterCommand = "AT#USBCFG=3"
 			modem.EcmModeResponse = "3"
+			modem.MultipleContexts = false
 		} else {
 			modem.EcmModeSetterCommand = "AT#USBCFG=4"
 			modem.EcmModeResponse = "4"
+			modem.MultipleContexts = true
 		}
 	}
 }
@@ -125,20 +166,50 @@ func (m *Modem) DetectModem() (string, error) {
 }
 
 func (m *Modem) ConfigureApn() error {
-	expectedApn := fmt.Sprintf("\"%s\"", Config.APN)
+	currentApn := m.CurrentApn()
+	return m.configurePDPContext(currentApn, Config.ApnProfile(currentApn))
+}
+
+func (m *Modem) configurePDPContext(apnName string, profile ApnProfile) error {
 	apn, err := RunModemManagerCommand("AT+CGDCONT?")
 	if err != nil {
 		return fmt.Errorf("unable to get apn from modem, err: %v", err)
 	}
 
-	if strings.Contains(apn, expectedApn) {
-		zap.S().Info("apn is up-to-date")
+	if pdpContextMatches(parseCgdcont(apn), apnName, profile) {
+		zap.S().Infof("apn %s is up-to-date", apnName)
 	} else {
-		output, err := RunModemManagerCommand("AT+CGDCONT=1,\"IPV4V6\",\"" + config.APN + "\"")
+		command := fmt.Sprintf("AT+CGDCONT=%d,\"%s\",\"%s\"", profile.ContextID, profile.PDPType, apnName)
+		output, err := RunModemManagerCommand(command)
 		if err != nil {
 			return fmt.Errorf("unable to update apn on modem, err: %v", err)
 		}
-		zap.S().Info("apn updated with %s", output)
+		zap.S().Infof("apn updated with %s", output)
+	}
+
+	authCommand, err := apnAuthCommand(m.Vendor, apnName, profile)
+	if err != nil {
+		return err
+	}
+
+	output, err := RunModemManagerCommand(authCommand)
+	if err != nil {
+		return fmt.Errorf("unable to set apn authentication on modem, err: %s", redactApnCredentials(err.Error(), profile))
+	}
+
+	if !strings.Contains(output, "OK") {
+		return fmt.Errorf("apn authentication rejected by modem, output: %s", redactApnCredentials(output, profile))
+	}
+
+	// Read it back, some firmwares answer OK and then quietly keep the old context
+	apn, err = RunModemManagerCommand("AT+CGDCONT?")
+	if err != nil {
+		return fmt.Errorf("unable to get apn from modem, err: %v", err)
+	}
+
+	if !pdpContextMatches(parseCgdcont(apn), apnName, profile) {
+		return fmt.Errorf("pdp context %d was not set to %s %s, modem reports: %s",
+			profile.ContextID, profile.PDPType, apnName, apn)
 	}
 
 	return nil
@@ -148,11 +219,25 @@ func (m *Modem) ConfigureModem() error {
 	forceReset := 0
 	zap.S().Info("modem configuration started")
 
+	m.RefreshApnLadder()
 	err := m.ConfigureApn()
 	if err != nil {
 		return err
 	}
 
+	err = m.ConfigureAdditionalContexts()
+	if err != nil {
+		return err
+	}
+
+	// Without it the time is only as good as the system clock, not worth failing over
+	err = m.EnableNetworkTime()
+	if err != nil {
+		zap.S().Errorf("unable to enable network time, error: %v", err)
+	}
+
+	m.ConfigureNetworkLock()
+
 	zap.S().Info("checking modem mode...")
 	ecmMode, err := RunModemManagerCommand(m.ModeStatusCommand)
 	if err != nil {
@@ -232,11 +317,11 @@ func checkModemStarted(modem *Modem) error {
 	}
 
 	for i := 0; i < 20; i++ {
-		output, err := RunShellCommand("route -n")
+		hasRoute, err := interfaceHasRoute(modem.InterfaceName)
 		if err != nil {
 			zap.S().Error("error trying to get modem information, error: %v", err)
 		}
-		if strings.Contains(output, modem.InterfaceName) {
+		if hasRoute {
 			zap.S().Info("modem started")
 			counter = 0
 			result += 1
@@ -349,14 +434,14 @@ func (m *Modem) InitiateECM() error {
 		return fmt.Errorf("error occured when checking pdp status, output: %s", output)
 	}
 
-	if strings.Contains(output, "0,1") || strings.Contains(output, "1,1") {
+	if m.pdpContextActive(output) {
 		zap.S().Info("ECM is already initiated")
 		time.Sleep(10 * time.Second)
 		return nil
 	}
 
 	zap.S().Info("ECM connection is initiating...")
-	output, err = RunModemManagerCommand(m.PDPActivateCommand)
+	output, err = RunModemManagerCommand(m.pdpActivateCommand())
 	if err != nil {
 		return fmt.Errorf("an error occured when initiating ecm connection, error: %v", err)
 	}
@@ -376,7 +461,7 @@ func (m *Modem) InitiateECM() error {
 			continue
 		}
 
-		if strings.Contains(output, "0,1") || strings.Contains(output, "1,1") {
+		if m.pdpContextActive(output) {
 			zap.S().Info("ECM is already initiated")
 			time.Sleep(10 * time.Second)
 			return nil
@@ -385,11 +470,23 @@ func (m *Modem) InitiateECM() error {
 		}
 	}
 
-	return fmt.Errorf("ECM initiation timeout")
+	return fmt.Errorf("%w with apn %s", errEcmTimeout, m.CurrentApn())
 }
 
 func (m *Modem) CheckInternet() error {
-	latency, err := checkInterfaceHealth(m.InterfaceName, config.PingTimeout)
+	health, connectivity, err := checkUplinkConnectivity(m.InterfaceName, Config.PingTimeout)
+	m.MonitoringProperties.CellularIPv4Connection = health.IPv4Connection
+	m.MonitoringProperties.CellularIPv4Latency = health.IPv4Latency
+	m.MonitoringProperties.CellularIPv6Connection = health.IPv6Connection
+	m.MonitoringProperties.CellularIPv6Latency = health.IPv6Latency
+	m.MonitoringProperties.CellularProbes = append(health.IPv4Probes, health.IPv6Probes...)
+	m.MonitoringProperties.CellularChecks = connectivity.Checks
+	m.DiagnosticProperties.FailedLayer = connectivity.FailedLayer
+	m.DiagnosticProperties.CaptivePortal = connectivity.CaptivePortal
+
+	if err == nil {
+		err = wireGuard.HealthError(m.InterfaceName)
+	}
 	if err != nil {
 		m.MonitoringProperties.CellularConnection = false
 		m.MonitoringProperties.CellularLatency = 0
@@ -397,31 +494,89 @@ func (m *Modem) CheckInternet() error {
 	}
 
 	m.MonitoringProperties.CellularConnection = true
-	m.MonitoringProperties.CellularLatency = latency
+	m.MonitoringProperties.CellularLatency = health.Latency()
 	return nil
 
 }
 
-func checkInterfaceHealth(interfaceName string, pingTimeout int) (int, error) {
-	pingResult, err := RunShellCommand(fmt.Sprintf("ping -1 -c 1 -s 8 -w %s -I %s 8.8.8.8", string(pingTimeout), interfaceName))
-	if err != nil {
-		return 0, fmt.Errorf("no internet, error: %v", err)
+type FamilyHealth struct {
+	IPv4Connection bool
+	IPv4Latency    int
+	IPv4Probes     []ProbeResult
+	IPv6Connection bool
+	IPv6Latency    int
+	IPv6Probes     []ProbeResult
+}
+
+// Latency prefers IPv4 so the number stays comparable with what we reported before
+func (h FamilyHealth) Latency() int {
+	if h.IPv4Connection {
+		return h.IPv4Latency
 	}
 
-	pingLatencies := parsePingOutput(pingResult, "min/avg/max/mdev =", "ms")
-	latenciesValues, err := strconv.ParseFloat(strings.Split(pingLatencies, "/")[0], 32)
+	return h.IPv6Latency
+}
+
+// checkDualStackHealth probes the IPv4 and IPv6 targets separately. The interface is healthy if
+// either family works, IPv6-only networks are common on mobile and shouldn't count as down.
+func checkDualStackHealth(interfaceName string, pingTimeout int) (FamilyHealth, error) {
+	health := FamilyHealth{}
+
+	var errV4, errV6 error
+	health.IPv4Probes, health.IPv4Latency, errV4 = checkInterfaceFamilyHealth(interfaceName, pingTimeout, Config.IPv4PingTargets)
+	health.IPv4Connection = errV4 == nil
+
+	health.IPv6Probes, health.IPv6Latency, errV6 = checkInterfaceFamilyHealth(interfaceName, pingTimeout, Config.IPv6PingTargets)
+	health.IPv6Connection = errV6 == nil
+
+	if errV4 != nil && errV6 != nil {
+		return health, fmt.Errorf("no internet over ipv4 (%v) or ipv6 (%v)", errV4, errV6)
+	}
+
+	return health, nil
+}
+
+func checkInterfaceHealth(interfaceName string, pingTimeout int) (int, error) {
+	health, err := checkDualStackHealth(interfaceName, pingTimeout)
 	if err != nil {
-		return 0, fmt.Errorf("issue converting ping data to numeric, error: %v", err)
+		return 0, err
 	}
-	return int(latenciesValues), nil
+
+	return health.Latency(), nil
 }
 
-func parsePingOutput(output, header, end string) string {
-	header += " "
-	headerSize := len(header)
-	indexOfData := strings.Index(output, header) + headerSize
-	endOfData := indexOfData + strings.Index(output[indexOfData:], end)
-	return output[indexOfData:endOfData]
+// checkInterfaceFamilyHealth returns the probe results and the average round trip of the
+// targets that answered. pingTimeout is the budget for a whole round, split across the probes.
+func checkInterfaceFamilyHealth(interfaceName string, pingTimeout int, targets []string) ([]ProbeResult, int, error) {
+	if len(targets) == 0 {
+		return nil, 0, fmt.Errorf("no ping targets configured")
+	}
+
+	count := Config.ProbeCount
+	if count < 1 {
+		count = 1
+	}
+
+	timeout := time.Duration(pingTimeout) * time.Second / time.Duration(count)
+	if timeout < time.Second {
+		timeout = time.Second
+	}
+
+	results, healthy := probeTargets(interfaceName, targets, count, Config.ProbeQuorum, timeout)
+	if !healthy {
+		return results, 0, fmt.Errorf("no internet, fewer than %d of %v answered", Config.ProbeQuorum, targets)
+	}
+
+	total := 0.0
+	answered := 0
+	for _, result := range results {
+		if result.Received > 0 {
+			total += result.AvgRTT
+			answered++
+		}
+	}
+
+	return results, int(total / float64(answered)), nil
 }
 
 func (m *Modem) Diagnose(diagnosisType int) error {
@@ -438,13 +593,13 @@ func (m *Modem) Diagnose(diagnosisType int) error {
 		UsbInterface:    false,
 	}
 
+	var err error
 	zap.S().Info("diagnostic is working...")
 	zap.S().Info("[1] - does the connection interface exist?")
-	routeData, err := RunShellCommand("route -n")
+	m.DiagnosticProperties.ConnInterface, err = interfaceHasRoute(m.InterfaceName)
 	if err != nil {
 		return fmt.Errorf("error checking route information, error: %v", err)
 	}
-	m.DiagnosticProperties.ConnInterface = strings.Contains(routeData, m.InterfaceName)
 
 	zap.S().Info("[2] - does the USB interface exist?")
 	usbInterface, err := RunShellCommand("lsusb")
@@ -474,7 +629,7 @@ func (m *Modem) Diagnose(diagnosisType int) error {
 	if err != nil {
 		return fmt.Errorf("error checking ECM PDP context information, error: %v", err)
 	}
-	if strings.Contains(response, "1,1") {
+	if m.pdpContextActive(response) {
 		m.DiagnosticProperties.PDPContext = true
 	}
 
@@ -483,12 +638,11 @@ func (m *Modem) Diagnose(diagnosisType int) error {
 	m.DiagnosticProperties.NetworkReqister = (err == nil)
 
 	zap.S().Info("[7] - is the APN ok?")
-	expectedApn := fmt.Sprintf("\"%s\"", Config.APN)
 	apn, err := RunModemManagerCommand("AT+CGDCONT?")
 	if err != nil {
 		return fmt.Errorf("unable to get apn from modem, err: %v", err)
 	}
-	m.DiagnosticProperties.ModemApn = strings.Contains(apn, expectedApn)
+	m.DiagnosticProperties.ModemApn = pdpContextMatches(parseCgdcont(apn), m.CurrentApn(), Config.ApnProfile(m.CurrentApn()))
 
 	zap.S().Info("[8] - is the modem mode ok?")
 	mode, err := RunModemManagerCommand(m.ModeStatusCommand)
@@ -504,6 +658,50 @@ func (m *Modem) Diagnose(diagnosisType int) error {
 	}
 	m.DiagnosticProperties.SimReady = strings.Contains(simStatus, "READY")
 
+	zap.S().Info("[9] - does the interface address match the PDP context address?")
+	// A missing interface or an inactive context is what diagnosis is there to report, not a
+	// reason to stop before the report is written
+	m.DiagnosticProperties.PDPAddressError = ""
+	m.DiagnosticProperties.PDPAddressMatch, err = m.UpdatePDPAddressing()
+	if err != nil {
+		zap.S().Errorf("error checking pdp context address, error: %v", err)
+		m.DiagnosticProperties.PDPAddressError = err.Error()
+	}
+
+	zap.S().Info("[10] - does the connection interface have a global IPv6 address?")
+	interfaceState, err := getInterfaceState(m.InterfaceName)
+	if err != nil && !errors.Is(err, errInterfaceNotFound) {
+		return fmt.Errorf("error checking ipv6 information, error: %v", err)
+	}
+	m.DiagnosticProperties.IPv6Address = len(interfaceState.GlobalAddresses(true)) > 0
+
+	zap.S().Info("[11] - is there an IPv6 route through the connection interface?")
+	m.DiagnosticProperties.IPv6Route = interfaceState.HasDefaultRoute(true)
+
+	zap.S().Info("[12] - which connectivity layer fails?")
+	_, connectivity, _ := checkUplinkConnectivity(m.InterfaceName, Config.PingTimeout)
+	m.DiagnosticProperties.FailedLayer = connectivity.FailedLayer
+	m.DiagnosticProperties.CaptivePortal = connectivity.CaptivePortal
+
+	zap.S().Info("[13] - what is the path mtu?")
+	m.checkPathMTU()
+
+	zap.S().Info("[14] - where does the path to the internet stop?")
+	hops, err := traceroute(m.InterfaceName, Config.TracerouteTarget, Config.TracerouteMode,
+		Config.TracerouteMaxHops, time.Duration(Config.OtherPingTimeout)*time.Second)
+	if err != nil {
+		zap.S().Errorf("unable to trace the path to %s, error: %v", Config.TracerouteTarget, err)
+	}
+	m.DiagnosticProperties.Traceroute = hops
+
+	zap.S().Info("[15] - does dns resolve through the carrier and a public resolver?")
+	m.DiagnosticProperties.DNSResults = checkDNSServers(m.InterfaceName, m.MonitoringProperties.CellularDNS,
+		time.Duration(Config.OtherPingTimeout)*time.Second)
+
+	zap.S().Info("[16] - is the modem held on a locked cell?")
+	cellLock.Check(m)
+	m.DiagnosticProperties.CellLock = cellLock.Status()
+
 	m.DiagnosticProperties.Timestamp = time.Now()
 
 	switch diagnosisType {
@@ -537,23 +735,13 @@ func (m *Modem) Diagnose(diagnosisType int) error {
 }
 
 func (m *Modem) ResetConnectionInterface() error {
-	down := fmt.Sprintf("sudo ip link set dev %s down", m.InterfaceName)
-	up := fmt.Sprintf("sudo ip link set dev %s up", m.InterfaceName)
+	timeout := time.Duration(Config.InterfaceResetTimeout) * time.Second
 
 	zap.S().Info("resetting connection interface...")
-	_, err := RunShellCommand(down)
-	if err != nil {
-		return fmt.Errorf("error bringing interface down, error: %v", err)
-	}
-	zap.S().Info("interface %s is down", m.InterfaceName)
-
-	time.Sleep(5 * time.Second)
-
-	_, err = RunShellCommand(up)
+	err := bounceInterface(m.InterfaceName, timeout)
 	if err != nil {
-		return fmt.Errorf("error bringing interface up, error: %v", err)
+		return fmt.Errorf("error resetting connection interface, error: %v", err)
 	}
-	zap.S().Info("interface %s is up", m.InterfaceName)
 
 	err = checkifModemInterfaceIsUp(m)
 	if err != nil {
@@ -563,29 +751,19 @@ func (m *Modem) ResetConnectionInterface() error {
 	return nil
 }
 
+// Carrier alone isn't enough, DHCP still has to hand out an address and install routes
 func checkifModemInterfaceIsUp(modem *Modem) error {
-	counter := 0
-	zap.S().Debug("interface name: %s", modem.InterfaceName)
-	for i := 0; i < 20; i++ {
-		output, err := RunShellCommand("route -n")
-		if err != nil {
-			zap.S().Error("error trying to get modem interface data, error: %v", err)
-		}
-		if strings.Contains(output, modem.InterfaceName) {
-			zap.S().Info("modem interface detected")
-			counter = 0
-			break
-		} else {
-			time.Sleep(1 * time.Second)
-			counter += 1
-			fmt.Println(string(counter) + " attempts to get ensure modem is up")
-		}
-	}
+	zap.S().Debugf("interface name: %s", modem.InterfaceName)
+	timeout := time.Duration(Config.InterfaceResetTimeout) * time.Second
 
-	if counter != 0 {
-		return fmt.Errorf("modem interface couldn't be detected")
+	err := waitForInterface(modem.InterfaceName, timeout, func(state InterfaceState) bool {
+		return state.Up && state.HasRoute()
+	})
+	if err != nil {
+		return fmt.Errorf("modem interface couldn't be detected, error: %v", err)
 	}
 
+	zap.S().Info("modem interface detected")
 	return nil
 }
 
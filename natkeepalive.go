@@ -0,0 +1,420 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	stunBindingRequest   = 0x0001
+	stunBindingResponse  = 0x0101
+	stunBindingError     = 0x0111
+	stunMagicCookie      = 0x2112a442
+	stunMappedAddress    = 0x0001
+	stunXorMappedAddress = 0x0020
+	stunResponsePort     = 0x0027
+
+	// Binary search on the NAT timeout stops once the bounds are this close, in seconds
+	natTimeoutPrecision = 10
+	natTimeoutRemeasure = 24 * time.Hour
+)
+
+type KeepaliveStatus struct {
+	Interface          string
+	Mode               string
+	Target             string
+	Interval           int
+	MeasuredNatTimeout int // seconds, 0 until a measurement finished
+	Measuring          bool
+	LastMeasurement    time.Time
+	Sent               int
+	Failed             int
+	LastSent           time.Time
+	LastError          string
+}
+
+// stunRequest builds a binding request. With a responsePort the server is asked to answer to
+// that port instead of the one the request came from (RESPONSE-PORT, RFC 5780).
+func stunRequest(responsePort int) ([]byte, error) {
+	request := make([]byte, 20)
+	binary.BigEndian.PutUint16(request[0:], stunBindingRequest)
+	binary.BigEndian.PutUint32(request[4:], stunMagicCookie)
+	_, err := rand.Read(request[8:20])
+	if err != nil {
+		return nil, err
+	}
+
+	if responsePort > 0 {
+		attribute := make([]byte, 8)
+		binary.BigEndian.PutUint16(attribute[0:], stunResponsePort)
+		binary.BigEndian.PutUint16(attribute[2:], 4)
+		binary.BigEndian.PutUint16(attribute[4:], uint16(responsePort))
+		request = append(request, attribute...)
+	}
+	binary.BigEndian.PutUint16(request[2:], uint16(len(request)-20))
+
+	return request, nil
+}
+
+// readStunResponse waits for the answer to the request, an error response becomes an error
+func readStunResponse(conn net.Conn, request []byte, timeout time.Duration) ([]byte, error) {
+	err := conn.SetReadDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return nil, err
+	}
+
+	buffer := make([]byte, 1500)
+	for {
+		length, err := conn.Read(buffer)
+		if err != nil {
+			return nil, fmt.Errorf("no answer from stun server, error: %w", err)
+		}
+
+		response := buffer[:length]
+		if length < 20 || !bytes.Equal(response[8:20], request[8:20]) {
+			continue
+		}
+
+		switch binary.BigEndian.Uint16(response[0:]) {
+		case stunBindingResponse:
+			return response, nil
+		case stunBindingError:
+			return nil, fmt.Errorf("stun server rejected the request")
+		}
+	}
+}
+
+// stunMapping asks a STUN server which public address and port our socket shows up as
+func stunMapping(conn net.Conn, timeout time.Duration) (string, error) {
+	request, err := stunRequest(0)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = conn.Write(request)
+	if err != nil {
+		return "", err
+	}
+
+	response, err := readStunResponse(conn, request, timeout)
+	if err != nil {
+		return "", err
+	}
+
+	return parseStunMapping(response)
+}
+
+// bindingAlive tells whether the idle socket's NAT binding still exists without sending
+// anything from it, which would refresh the binding or, on a NAT that keeps the port, quietly
+// make the same one again. The request goes out of a second socket and the answer is sent
+// to the idle binding's public port, so it only arrives while that binding is there.
+func bindingAlive(idle net.Conn, probe net.Conn, mappedPort int, timeout time.Duration) (bool, error) {
+	request, err := stunRequest(mappedPort)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = probe.Write(request)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = readStunResponse(idle, request, timeout)
+	if err == nil {
+		return true, nil
+	}
+
+	// A server without RESPONSE-PORT rejects it or answers the probe socket instead
+	_, probeErr := readStunResponse(probe, request, 100*time.Millisecond)
+	if probeErr == nil || !errors.Is(probeErr, os.ErrDeadlineExceeded) {
+		return false, fmt.Errorf("stun server doesn't support RESPONSE-PORT")
+	}
+
+	return false, nil
+}
+
+func parseStunMapping(response []byte) (string, error) {
+	attributes := response[20:]
+	mapped := ""
+	for len(attributes) >= 4 {
+		attributeType := binary.BigEndian.Uint16(attributes[0:])
+		length := int(binary.BigEndian.Uint16(attributes[2:]))
+		if 4+length > len(attributes) {
+			break
+		}
+		value := attributes[4 : 4+length]
+
+		// Only IPv4 mappings are of interest, IPv6 on mobile networks isn't behind a NAT
+		if (attributeType == stunXorMappedAddress || attributeType == stunMappedAddress) && length >= 8 && value[1] == 0x01 {
+			port := binary.BigEndian.Uint16(value[2:])
+			ip := copyIP(value[4:8])
+			if attributeType == stunXorMappedAddress {
+				port ^= uint16(stunMagicCookie >> 16)
+				binary.BigEndian.PutUint32(ip, binary.BigEndian.Uint32(ip)^stunMagicCookie)
+				return fmt.Sprintf("%s:%d", ip, port), nil
+			}
+			mapped = fmt.Sprintf("%s:%d", ip, port)
+		}
+
+		// Attributes are padded to four bytes
+		next := 4 + (length+3)&^3
+		if next > len(attributes) {
+			break
+		}
+		attributes = attributes[next:]
+	}
+
+	if mapped == "" {
+		return "", fmt.Errorf("stun response has no mapped address")
+	}
+
+	return mapped, nil
+}
+
+// sleepOrStop waits unless the keepalive is being stopped, it returns false in that case
+func sleepOrStop(duration time.Duration, stop chan struct{}) bool {
+	select {
+	case <-stop:
+		return false
+	case <-time.After(duration):
+		return true
+	}
+}
+
+// measureNatTimeout finds how long the carrier keeps an idle UDP binding by leaving a socket
+// idle for a while and checking whether its binding is still there, narrowing the idle time
+// down by bisection. It takes a while, every step waits out the idle time.
+func measureNatTimeout(interfaceName string, config KeepaliveConfig, stop chan struct{}) (int, error) {
+	timeout := time.Duration(Config.PingTimeout) * time.Second
+	dialer := boundDialer(interfaceName, timeout)
+	conn, err := dialer.Dial("udp4", config.StunServer)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	low, high := config.MinInterval, config.MaxInterval
+	idle := high
+	for {
+		// Every step starts from a fresh binding, or a refreshed one if it survived
+		mapping, err := stunMapping(conn, timeout)
+		if err != nil {
+			return 0, err
+		}
+		_, port, err := net.SplitHostPort(mapping)
+		if err != nil {
+			return 0, err
+		}
+		mappedPort, _ := strconv.Atoi(port)
+
+		if !sleepOrStop(time.Duration(idle)*time.Second, stop) {
+			return 0, fmt.Errorf("stopped")
+		}
+
+		probe, err := dialer.Dial("udp4", config.StunServer)
+		if err != nil {
+			return 0, err
+		}
+		alive, err := bindingAlive(conn, probe, mappedPort, timeout)
+		probe.Close()
+		if err != nil {
+			return 0, err
+		}
+
+		if alive {
+			if idle == config.MaxInterval {
+				// The binding outlives the longest interval we would use anyway
+				return config.MaxInterval, nil
+			}
+			low = idle
+		} else {
+			high = idle
+		}
+
+		if high-low <= natTimeoutPrecision {
+			return low, nil
+		}
+		idle = (low + high) / 2
+	}
+}
+
+type keepaliveRunner struct {
+	config KeepaliveConfig
+	status *KeepaliveStatus
+	stop   chan struct{}
+}
+
+// NatKeepalive sends a small packet out of each configured cellular interface often enough
+// that the carrier sees the session as active.
+type NatKeepalive struct {
+	mutex   sync.Mutex
+	runners map[string]*keepaliveRunner
+}
+
+var natKeepalive = NatKeepalive{runners: map[string]*keepaliveRunner{}}
+
+func (n *NatKeepalive) Statuses() map[string]KeepaliveStatus {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	statuses := map[string]KeepaliveStatus{}
+	for interfaceName, runner := range n.runners {
+		statuses[interfaceName] = *runner.status
+	}
+	return statuses
+}
+
+func (n *NatKeepalive) update(runner *keepaliveRunner, change func(status *KeepaliveStatus)) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	change(runner.status)
+}
+
+func (n *NatKeepalive) interval(runner *keepaliveRunner) time.Duration {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return time.Duration(runner.status.Interval) * time.Second
+}
+
+// Manage starts a keepalive for every configured interface and restarts the ones whose
+// configuration changed
+func (n *NatKeepalive) Manage() {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	for interfaceName, runner := range n.runners {
+		config, ok := Config.Keepalives[interfaceName]
+		if !ok || !reflect.DeepEqual(config.withDefaults(), runner.config) {
+			close(runner.stop)
+			delete(n.runners, interfaceName)
+		}
+	}
+
+	for interfaceName, config := range Config.Keepalives {
+		if _, ok := n.runners[interfaceName]; ok {
+			continue
+		}
+
+		config = config.withDefaults()
+		if config.Target == "" {
+			zap.S().Errorf("keepalive on %s has no target", interfaceName)
+			continue
+		}
+
+		runner := &keepaliveRunner{
+			config: config,
+			status: &KeepaliveStatus{
+				Interface: interfaceName,
+				Mode:      config.Mode,
+				Target:    config.Target,
+				Interval:  config.Interval,
+			},
+			stop: make(chan struct{}),
+		}
+		n.runners[interfaceName] = runner
+
+		go n.run(interfaceName, runner)
+		if config.Adaptive {
+			go n.adapt(interfaceName, runner)
+		}
+	}
+}
+
+func (n *NatKeepalive) run(interfaceName string, runner *keepaliveRunner) {
+	var conn net.Conn
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+
+	for sleepOrStop(n.interval(runner), runner.stop) {
+		var err error
+		switch runner.config.Mode {
+		case "icmp":
+			var result ProbeResult
+			result, err = probeTarget(interfaceName, runner.config.Target, 1, time.Duration(Config.PingTimeout)*time.Second)
+			if err == nil && result.Received == 0 {
+				err = fmt.Errorf("no reply from %s", runner.config.Target)
+			}
+		case "udp":
+			// One socket for as long as it works, so it keeps its own binding alive too
+			if conn == nil {
+				conn, err = boundDialer(interfaceName, time.Duration(Config.PingTimeout)*time.Second).Dial("udp", runner.config.Target)
+			}
+			if err == nil {
+				_, err = conn.Write([]byte{0})
+				if err != nil {
+					conn.Close()
+					conn = nil
+				}
+			}
+		default:
+			err = fmt.Errorf("unknown keepalive mode %s", runner.config.Mode)
+		}
+
+		n.update(runner, func(status *KeepaliveStatus) {
+			status.Sent++
+			status.LastSent = time.Now()
+			status.LastError = ""
+			if err != nil {
+				status.Failed++
+				status.LastError = err.Error()
+			}
+		})
+		if err != nil {
+			zap.S().Debugf("keepalive on %s failed, error: %v", interfaceName, err)
+		}
+	}
+}
+
+// adapt measures the NAT timeout and sets the interval to 90% of it. The measurement is
+// repeated once a day since carriers change their timeouts, and retried sooner if it failed.
+func (n *NatKeepalive) adapt(interfaceName string, runner *keepaliveRunner) {
+	for {
+		n.update(runner, func(status *KeepaliveStatus) { status.Measuring = true })
+		zap.S().Infof("measuring nat timeout on %s", interfaceName)
+
+		natTimeout, err := measureNatTimeout(interfaceName, runner.config, runner.stop)
+		select {
+		case <-runner.stop:
+			return
+		default:
+		}
+
+		wait := natTimeoutRemeasure
+		if err != nil {
+			zap.S().Warnf("unable to measure nat timeout on %s, error: %v", interfaceName, err)
+			wait = time.Duration(runner.config.MaxInterval) * time.Second
+		} else {
+			interval := natTimeout * 9 / 10
+			if interval < runner.config.MinInterval {
+				interval = runner.config.MinInterval
+			}
+			zap.S().Infof("nat timeout on %s is about %d seconds, keepalive every %d seconds",
+				interfaceName, natTimeout, interval)
+
+			n.update(runner, func(status *KeepaliveStatus) {
+				status.MeasuredNatTimeout = natTimeout
+				status.LastMeasurement = time.Now()
+				status.Interval = interval
+			})
+		}
+		n.update(runner, func(status *KeepaliveStatus) { status.Measuring = false })
+
+		if !sleepOrStop(wait, runner.stop) {
+			return
+		}
+	}
+}
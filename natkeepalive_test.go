@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// startFakeStunServer answers binding requests with the XOR-MAPPED-ADDRESS of the sender, and
+// to RESPONSE-PORT when honourResponsePort is set
+func startFakeStunServer(t *testing.T, honourResponsePort bool) string {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("unable to listen for stun, error: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buffer := make([]byte, 1500)
+		for {
+			length, from, err := conn.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+			request := buffer[:length]
+
+			destination := *from
+			attributes := request[20:]
+			if len(attributes) >= 8 && binary.BigEndian.Uint16(attributes) == stunResponsePort && honourResponsePort {
+				destination.Port = int(binary.BigEndian.Uint16(attributes[4:]))
+			}
+
+			response := make([]byte, 32)
+			binary.BigEndian.PutUint16(response[0:], stunBindingResponse)
+			binary.BigEndian.PutUint16(response[2:], 12)
+			copy(response[4:20], request[4:20])
+			binary.BigEndian.PutUint16(response[20:], stunXorMappedAddress)
+			binary.BigEndian.PutUint16(response[22:], 8)
+			response[25] = 0x01
+			binary.BigEndian.PutUint16(response[26:], uint16(from.Port)^uint16(stunMagicCookie>>16))
+			binary.BigEndian.PutUint32(response[28:], binary.BigEndian.Uint32(from.IP.To4())^stunMagicCookie)
+			conn.WriteToUDP(response, &destination)
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+func TestStunMapping(t *testing.T) {
+	server := startFakeStunServer(t, true)
+	conn, err := net.Dial("udp4", server)
+	if err != nil {
+		t.Fatalf("unable to reach fake stun server, error: %v", err)
+	}
+	defer conn.Close()
+
+	mapping, err := stunMapping(conn, time.Second)
+	if err != nil {
+		t.Fatalf("no mapping, error: %v", err)
+	}
+	if mapping != conn.LocalAddr().String() {
+		t.Errorf("mapping is %s, want %s", mapping, conn.LocalAddr())
+	}
+}
+
+func TestBindingAlive(t *testing.T) {
+	tests := []struct {
+		name               string
+		honourResponsePort bool
+		bindingGone        bool
+		wantAlive          bool
+		wantErr            bool
+	}{
+		{"binding there", true, false, true, false},
+		// The idle socket going away stands in for the NAT dropping its binding
+		{"binding gone", true, true, false, false},
+		{"no response-port", false, false, false, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := startFakeStunServer(t, test.honourResponsePort)
+			idle, err := net.Dial("udp4", server)
+			if err != nil {
+				t.Fatalf("unable to reach fake stun server, error: %v", err)
+			}
+			defer func() { idle.Close() }()
+			probe, err := net.Dial("udp4", server)
+			if err != nil {
+				t.Fatalf("unable to reach fake stun server, error: %v", err)
+			}
+			defer probe.Close()
+
+			idlePort := idle.LocalAddr().(*net.UDPAddr).Port
+			if test.bindingGone {
+				// The answer goes to the old port, nothing listens there anymore
+				idle.Close()
+				idle, err = net.Dial("udp4", server)
+				if err != nil {
+					t.Fatalf("unable to reach fake stun server, error: %v", err)
+				}
+			}
+
+			alive, err := bindingAlive(idle, probe, idlePort, 200*time.Millisecond)
+			if alive != test.wantAlive || (err != nil) != test.wantErr {
+				t.Errorf("bindingAlive = %t, %v, want %t and error %t", alive, err, test.wantAlive, test.wantErr)
+			}
+		})
+	}
+}
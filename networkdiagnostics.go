@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+	"unsafe"
+
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	tracerouteBasePort = 33434
+	// Stop once this many hops in a row stay silent, the rest of the path is most likely too
+	tracerouteSilentHops = 5
+	icmpUnreachable      = 3
+)
+
+type TracerouteHop struct {
+	TTL     int
+	Address string  // empty when nothing answered
+	RTT     float64 // milliseconds
+	Reached bool
+}
+
+type DNSCheckResult struct {
+	Server    string
+	Host      string
+	Addresses []string
+	RTT       float64 // milliseconds
+	Error     string
+}
+
+// openTracerouteSocket gives a socket bound to the interface that sends with the given TTL and
+// queues the ICMP errors coming back, so no raw socket is needed to see them, same as tracepath.
+func openTracerouteSocket(interfaceName string, mode string, ttl int) (*icmpSocket, error) {
+	var socket *icmpSocket
+	if mode == "icmp" {
+		var err error
+		socket, err = openIcmpSocket(interfaceName, false)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, unix.IPPROTO_UDP)
+		if err != nil {
+			return nil, err
+		}
+		socket = &icmpSocket{fd: fd}
+
+		err = unix.BindToDevice(fd, interfaceName)
+		if err != nil {
+			socket.Close()
+			return nil, fmt.Errorf("unable to bind traceroute socket to %s, error: %v", interfaceName, err)
+		}
+	}
+
+	err := unix.SetsockoptInt(socket.fd, unix.IPPROTO_IP, unix.IP_TTL, ttl)
+	if err == nil {
+		err = unix.SetsockoptInt(socket.fd, unix.IPPROTO_IP, unix.IP_RECVERR, 1)
+	}
+	if err != nil {
+		socket.Close()
+		return nil, err
+	}
+
+	return socket, nil
+}
+
+// readQueuedError takes an ICMP error off the socket's error queue and returns who sent it
+func readQueuedError(fd int) (net.IP, *unix.SockExtendedErr, error) {
+	buffer := make([]byte, 1500)
+	oob := make([]byte, 512)
+	_, oobLength, _, _, err := unix.Recvmsg(fd, buffer, oob, unix.MSG_ERRQUEUE)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	messages, err := unix.ParseSocketControlMessage(oob[:oobLength])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, message := range messages {
+		if message.Header.Level != unix.IPPROTO_IP || message.Header.Type != unix.IP_RECVERR {
+			continue
+		}
+
+		// struct sock_extended_err, followed by the offender's sockaddr_in
+		size := int(unsafe.Sizeof(unix.SockExtendedErr{}))
+		if len(message.Data) < size+8 {
+			continue
+		}
+		extendedErr := *(*unix.SockExtendedErr)(unsafe.Pointer(&message.Data[0]))
+		return copyIP(message.Data[size+4 : size+8]), &extendedErr, nil
+	}
+
+	return nil, nil, fmt.Errorf("no icmp error in the queue")
+}
+
+// tracerouteHop sends one probe with the given TTL. The returned bool tells whether the trace
+// ends here, either at the target or at a router reporting it unreachable.
+func tracerouteHop(interfaceName string, mode string, target net.IP, ttl int, timeout time.Duration) (TracerouteHop, bool, error) {
+	hop := TracerouteHop{TTL: ttl}
+
+	socket, err := openTracerouteSocket(interfaceName, mode, ttl)
+	if err != nil {
+		return hop, false, err
+	}
+	defer socket.Close()
+
+	address := &unix.SockaddrInet4{Port: tracerouteBasePort + ttl}
+	copy(address.Addr[:], target.To4())
+	packet := []byte{0}
+	if mode == "icmp" {
+		address.Port = 0
+		packet = socket.echoRequest(uint16(ttl), 16)
+	}
+
+	start := time.Now()
+	err = unix.Sendto(socket.fd, packet, 0, address)
+	if err != nil {
+		return hop, false, err
+	}
+
+	deadline := start.Add(timeout)
+	buffer := make([]byte, 1500)
+	for {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return hop, false, nil
+		}
+
+		descriptors := []unix.PollFd{{Fd: int32(socket.fd), Events: unix.POLLIN}}
+		_, err = unix.Poll(descriptors, int(remaining.Milliseconds())+1)
+		if errors.Is(err, unix.EINTR) {
+			continue
+		}
+		if err != nil {
+			return hop, false, err
+		}
+
+		if descriptors[0].Revents&unix.POLLERR != 0 {
+			from, extendedErr, err := readQueuedError(socket.fd)
+			if err != nil || extendedErr.Origin != unix.SO_EE_ORIGIN_ICMP {
+				continue
+			}
+
+			hop.Address = from.String()
+			hop.RTT = float64(time.Since(start).Microseconds()) / 1000
+			// Port unreachable from the target is how a UDP trace ends, any other
+			// unreachable means the path ends there
+			hop.Reached = from.Equal(target)
+			return hop, hop.Reached || extendedErr.Type == icmpUnreachable, nil
+		}
+
+		if descriptors[0].Revents&unix.POLLIN != 0 {
+			length, from, err := unix.Recvfrom(socket.fd, buffer, unix.MSG_DONTWAIT)
+			if err != nil {
+				continue
+			}
+			if mode == "icmp" && !socket.isEchoReply(buffer[:length], uint16(ttl)) {
+				continue
+			}
+
+			hop.Address = sockaddrIP(from).String()
+			hop.RTT = float64(time.Since(start).Microseconds()) / 1000
+			hop.Reached = true
+			return hop, true, nil
+		}
+	}
+}
+
+// traceroute walks the path to the target out of the interface one TTL at a time. Only IPv4
+// for now, the hops we care about are the carrier's.
+func traceroute(interfaceName string, target string, mode string, maxHops int, timeout time.Duration) ([]TracerouteHop, error) {
+	ip := net.ParseIP(target).To4()
+	if ip == nil {
+		return nil, fmt.Errorf("traceroute target %s must be an ipv4 address", target)
+	}
+
+	hops := []TracerouteHop{}
+	silent := 0
+	for ttl := 1; ttl <= maxHops; ttl++ {
+		hop, done, err := tracerouteHop(interfaceName, strings.ToLower(mode), ip, ttl, timeout)
+		if err != nil {
+			return hops, err
+		}
+		hops = append(hops, hop)
+
+		if done {
+			break
+		}
+
+		if hop.Address == "" {
+			silent++
+			if silent >= tracerouteSilentHops {
+				break
+			}
+		} else {
+			silent = 0
+		}
+	}
+
+	return hops, nil
+}
+
+// resolveWith asks one DNS server directly, out of the interface, so carrier DNS and a public
+// resolver can be told apart
+func resolveWith(interfaceName string, server string, host string, timeout time.Duration) DNSCheckResult {
+	result := DNSCheckResult{Server: server, Host: host}
+
+	dialer := boundDialer(interfaceName, timeout)
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network string, address string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, net.JoinHostPort(server, "53"))
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	start := time.Now()
+	addresses, err := resolver.LookupHost(ctx, host)
+	result.RTT = float64(time.Since(start).Microseconds()) / 1000
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.Addresses = addresses
+
+	return result
+}
+
+// checkDNSServers resolves every DNSCheckHosts entry against the carrier DNS servers from the
+// PDP context and against the public ones. Carrier DNS failing while the public resolvers work
+// points at the carrier, both failing at the link.
+func checkDNSServers(interfaceName string, carrierServers []string, timeout time.Duration) []DNSCheckResult {
+	results := []DNSCheckResult{}
+	servers := append(append([]string{}, carrierServers...), Config.PublicDNSServers...)
+
+	for _, host := range Config.DNSCheckHosts {
+		for _, server := range servers {
+			result := resolveWith(interfaceName, server, host, timeout)
+			if result.Error != "" {
+				zap.S().Warnf("resolving %s with %s over %s failed, error: %s", host, server, interfaceName, result.Error)
+			}
+			results = append(results, result)
+		}
+	}
+
+	return results
+}
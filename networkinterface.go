@@ -0,0 +1,427 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+type InterfaceRoute struct {
+	Destination net.IPNet
+	Gateway     net.IP
+	Table       int
+	Metric      int
+	// Who added the route, e.g. the DHCP client or the kernel from a router advertisement,
+	// 0 is taken as RTPROT_BOOT
+	Protocol        int
+	PreferredSource net.IP
+	// Time left on routes from router advertisements, 0 for routes that don't expire
+	Expires time.Duration
+}
+
+func (r InterfaceRoute) IsDefault() bool {
+	ones, _ := r.Destination.Mask.Size()
+	return ones == 0
+}
+
+// InterfaceState is what the kernel knows about a network interface, read over rtnetlink so we
+// don't depend on net-tools being installed or on grepping their output.
+type InterfaceState struct {
+	Name      string
+	Index     int
+	Up        bool
+	Carrier   bool
+	OperState string
+	MTU       int
+	Addresses []net.IPNet
+	Routes    []InterfaceRoute
+	// Keyed by address, only present for addresses that expire, e.g. ones from a DHCP lease
+	AddressLifetimes map[string]time.Duration
+	// Since the interface was created, they start over when it is recreated or on reboot
+	RxBytes uint64
+	TxBytes uint64
+}
+
+// HasRoute ignores the fe80::/64 route every IPv6 capable link gets on its own
+func (s InterfaceState) HasRoute() bool {
+	for _, route := range s.Routes {
+		if !route.Destination.IP.IsLinkLocalUnicast() {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s InterfaceState) HasDefaultRoute(ipv6 bool) bool {
+	for _, route := range s.Routes {
+		if route.IsDefault() && (route.Destination.IP.To4() == nil) == ipv6 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// GlobalAddresses leaves out link-local addresses, which every interface has and which
+// say nothing about whether the network gave us anything.
+func (s InterfaceState) GlobalAddresses(ipv6 bool) []net.IPNet {
+	addresses := []net.IPNet{}
+	for _, address := range s.Addresses {
+		if (address.IP.To4() == nil) != ipv6 {
+			continue
+		}
+		if address.IP.IsLinkLocalUnicast() || address.IP.IsLoopback() {
+			continue
+		}
+		addresses = append(addresses, address)
+	}
+
+	return addresses
+}
+
+var errInterfaceNotFound = errors.New("interface doesn't exist")
+
+var operStates = map[uint8]string{
+	0: "unknown",
+	1: "notpresent",
+	2: "down",
+	3: "lowerlayerdown",
+	4: "testing",
+	5: "dormant",
+	6: "up",
+}
+
+func getInterfaceState(interfaceName string) (InterfaceState, error) {
+	states, err := getInterfaceStates()
+	if err != nil {
+		return InterfaceState{}, err
+	}
+
+	state, ok := states[interfaceName]
+	if !ok {
+		return InterfaceState{}, fmt.Errorf("%w: %s", errInterfaceNotFound, interfaceName)
+	}
+
+	return state, nil
+}
+
+// getInterfaceStates dumps links, addresses and routes from the kernel and groups them by
+// interface name.
+func getInterfaceStates() (map[string]InterfaceState, error) {
+	states := map[string]InterfaceState{}
+	names := map[int]string{}
+
+	links, err := netlinkDump(syscall.RTM_GETLINK)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list links, error: %v", err)
+	}
+
+	for _, message := range links {
+		if message.Header.Type != syscall.RTM_NEWLINK || len(message.Data) < syscall.SizeofIfInfomsg {
+			continue
+		}
+
+		info := (*syscall.IfInfomsg)(unsafe.Pointer(&message.Data[0]))
+		state := InterfaceState{
+			Index: int(info.Index),
+			Up:    info.Flags&syscall.IFF_UP != 0,
+		}
+
+		attributes, err := syscall.ParseNetlinkRouteAttr(&message)
+		if err != nil {
+			continue
+		}
+
+		for _, attribute := range attributes {
+			switch attribute.Attr.Type {
+			case syscall.IFLA_IFNAME:
+				state.Name = cString(attribute.Value)
+			case syscall.IFLA_MTU:
+				state.MTU = int(nativeUint32(attribute.Value))
+			case unix.IFLA_CARRIER:
+				state.Carrier = len(attribute.Value) > 0 && attribute.Value[0] == 1
+			case unix.IFLA_OPERSTATE:
+				if len(attribute.Value) > 0 {
+					state.OperState = operStates[attribute.Value[0]]
+				}
+			case unix.IFLA_STATS64:
+				// struct rtnl_link_stats64 starts with the packet counts, then the byte counts
+				if len(attribute.Value) >= 32 {
+					state.RxBytes = *(*uint64)(unsafe.Pointer(&attribute.Value[16]))
+					state.TxBytes = *(*uint64)(unsafe.Pointer(&attribute.Value[24]))
+				}
+			}
+		}
+
+		names[state.Index] = state.Name
+		states[state.Name] = state
+	}
+
+	addresses, err := netlinkDump(syscall.RTM_GETADDR)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list addresses, error: %v", err)
+	}
+
+	for _, message := range addresses {
+		if message.Header.Type != syscall.RTM_NEWADDR || len(message.Data) < syscall.SizeofIfAddrmsg {
+			continue
+		}
+
+		info := (*syscall.IfAddrmsg)(unsafe.Pointer(&message.Data[0]))
+		state, ok := states[names[int(info.Index)]]
+		if !ok {
+			continue
+		}
+
+		attributes, err := syscall.ParseNetlinkRouteAttr(&message)
+		if err != nil {
+			continue
+		}
+
+		var address net.IP
+		var validLifetime uint32
+		for _, attribute := range attributes {
+			// On point to point links IFA_ADDRESS is the peer, IFA_LOCAL is always ours
+			switch attribute.Attr.Type {
+			case syscall.IFA_LOCAL:
+				address = copyIP(attribute.Value)
+			case syscall.IFA_ADDRESS:
+				if address == nil {
+					address = copyIP(attribute.Value)
+				}
+			case syscall.IFA_CACHEINFO:
+				if len(attribute.Value) >= unix.SizeofIfaCacheinfo {
+					validLifetime = (*unix.IfaCacheinfo)(unsafe.Pointer(&attribute.Value[0])).Valid
+				}
+			}
+		}
+
+		if address == nil {
+			continue
+		}
+
+		// 0xffffffff is the kernel's "forever"
+		if validLifetime != 0 && validLifetime != 0xffffffff {
+			if state.AddressLifetimes == nil {
+				state.AddressLifetimes = map[string]time.Duration{}
+			}
+			state.AddressLifetimes[address.String()] = time.Duration(validLifetime) * time.Second
+		}
+
+		state.Addresses = append(state.Addresses, net.IPNet{
+			IP:   address,
+			Mask: net.CIDRMask(int(info.Prefixlen), len(address)*8),
+		})
+		states[state.Name] = state
+	}
+
+	routes, err := netlinkDump(syscall.RTM_GETROUTE)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list routes, error: %v", err)
+	}
+
+	for _, message := range routes {
+		if message.Header.Type != syscall.RTM_NEWROUTE || len(message.Data) < syscall.SizeofRtMsg {
+			continue
+		}
+
+		info := (*syscall.RtMsg)(unsafe.Pointer(&message.Data[0]))
+		if info.Type != syscall.RTN_UNICAST {
+			continue
+		}
+
+		attributes, err := syscall.ParseNetlinkRouteAttr(&message)
+		if err != nil {
+			continue
+		}
+
+		addressLength := net.IPv4len
+		if info.Family == syscall.AF_INET6 {
+			addressLength = net.IPv6len
+		}
+
+		route := InterfaceRoute{
+			Destination: net.IPNet{
+				IP:   make(net.IP, addressLength),
+				Mask: net.CIDRMask(int(info.Dst_len), addressLength*8),
+			},
+			Table:    int(info.Table),
+			Protocol: int(info.Protocol),
+		}
+		outputInterface := 0
+
+		for _, attribute := range attributes {
+			switch attribute.Attr.Type {
+			case syscall.RTA_DST:
+				route.Destination.IP = copyIP(attribute.Value)
+			case syscall.RTA_GATEWAY:
+				route.Gateway = copyIP(attribute.Value)
+			case syscall.RTA_OIF:
+				outputInterface = int(nativeUint32(attribute.Value))
+			case syscall.RTA_PRIORITY:
+				route.Metric = int(nativeUint32(attribute.Value))
+			case syscall.RTA_TABLE:
+				route.Table = int(nativeUint32(attribute.Value))
+			case syscall.RTA_PREFSRC:
+				route.PreferredSource = copyIP(attribute.Value)
+			case syscall.RTA_CACHEINFO:
+				// struct rta_cacheinfo, rta_expires is in USER_HZ ticks
+				if len(attribute.Value) >= 12 {
+					route.Expires = time.Duration(int32(nativeUint32(attribute.Value[8:12]))) * 10 * time.Millisecond
+				}
+			}
+		}
+
+		state, ok := states[names[outputInterface]]
+		if !ok {
+			continue
+		}
+
+		state.Routes = append(state.Routes, route)
+		states[state.Name] = state
+	}
+
+	return states, nil
+}
+
+func netlinkDump(request int) ([]syscall.NetlinkMessage, error) {
+	data, err := syscall.NetlinkRIB(request, syscall.AF_UNSPEC)
+	if err != nil {
+		return nil, err
+	}
+
+	return syscall.ParseNetlinkMessage(data)
+}
+
+func cString(value []byte) string {
+	for i, char := range value {
+		if char == 0 {
+			return string(value[:i])
+		}
+	}
+
+	return string(value)
+}
+
+func nativeUint32(value []byte) uint32 {
+	if len(value) < 4 {
+		return 0
+	}
+
+	return *(*uint32)(unsafe.Pointer(&value[0]))
+}
+
+func copyIP(value []byte) net.IP {
+	ip := make(net.IP, len(value))
+	copy(ip, value)
+	return ip
+}
+
+// interfaceHasRoute is what we used to get from looking for the interface in `route -n`,
+// the link is up and the kernel routes something through it.
+func interfaceHasRoute(interfaceName string) (bool, error) {
+	state, err := getInterfaceState(interfaceName)
+	if errors.Is(err, errInterfaceNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return state.Up && state.HasRoute(), nil
+}
+
+// netlinkExecute sends a single request on a netlink socket of the given protocol and collects
+// the replies. Requests are always acked so that errors from the kernel come back to us, dumps
+// are read until the kernel says it is done.
+func netlinkExecute(protocol int, messageType uint16, flags uint16, payload []byte) ([]syscall.NetlinkMessage, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, protocol)
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(fd)
+
+	err = syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK})
+	if err != nil {
+		return nil, err
+	}
+
+	request := make([]byte, syscall.NLMSG_HDRLEN+len(payload))
+	header := (*syscall.NlMsghdr)(unsafe.Pointer(&request[0]))
+	header.Len = uint32(len(request))
+	header.Type = messageType
+	header.Flags = flags | syscall.NLM_F_REQUEST | syscall.NLM_F_ACK
+	header.Seq = 1
+	copy(request[syscall.NLMSG_HDRLEN:], payload)
+
+	err = syscall.Sendto(fd, request, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK})
+	if err != nil {
+		return nil, err
+	}
+
+	replies := []syscall.NetlinkMessage{}
+	for {
+		// Parsed messages point into the buffer, so every read gets its own
+		buffer := make([]byte, 65536)
+		length, _, err := syscall.Recvfrom(fd, buffer, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		messages, err := syscall.ParseNetlinkMessage(buffer[:length])
+		if err != nil {
+			return nil, err
+		}
+
+		for _, message := range messages {
+			switch message.Header.Type {
+			case syscall.NLMSG_DONE:
+				return replies, nil
+			case syscall.NLMSG_ERROR:
+				if len(message.Data) < 4 {
+					return nil, fmt.Errorf("truncated netlink error")
+				}
+				errno := -int32(nativeUint32(message.Data[:4]))
+				if errno != 0 {
+					return nil, syscall.Errno(errno)
+				}
+				return replies, nil
+			default:
+				replies = append(replies, message)
+			}
+		}
+	}
+}
+
+func netlinkAlign(length int) int {
+	return (length + syscall.NLA_ALIGNTO - 1) &^ (syscall.NLA_ALIGNTO - 1)
+}
+
+// netlinkAttribute encodes one attribute including the padding the next one needs
+func netlinkAttribute(attributeType uint16, value []byte) []byte {
+	length := syscall.SizeofRtAttr + len(value)
+	attribute := make([]byte, netlinkAlign(length))
+	header := (*syscall.RtAttr)(unsafe.Pointer(&attribute[0]))
+	header.Len = uint16(length)
+	header.Type = attributeType
+	copy(attribute[syscall.SizeofRtAttr:], value)
+	return attribute
+}
+
+func nativeUint32Bytes(value uint32) []byte {
+	bytes := make([]byte, 4)
+	*(*uint32)(unsafe.Pointer(&bytes[0])) = value
+	return bytes
+}
+
+func structBytes(pointer unsafe.Pointer, size int) []byte {
+	bytes := make([]byte, size)
+	copy(bytes, (*[1 << 16]byte)(pointer)[:size:size])
+	return bytes
+}
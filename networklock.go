@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// modemSettingValues gives the values after the prefix in a query response, e.g. 0x93 and
+// 0x80084 for +QCFG: "band",0x93,0x80084
+func modemSettingValues(output string, prefix string) ([]string, bool) {
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, prefix) {
+			continue
+		}
+
+		values := []string{}
+		for _, value := range strings.Split(strings.TrimPrefix(line, prefix), ",") {
+			values = append(values, strings.Trim(strings.TrimSpace(value), "\""))
+		}
+		return values, true
+	}
+
+	return nil, false
+}
+
+// normalizeSettingValue lets 0x0080084 from the modem match 80084 from the configuration
+func normalizeSettingValue(value string) string {
+	value = strings.ToLower(strings.Trim(strings.TrimSpace(value), "\""))
+	value = strings.TrimLeft(strings.TrimPrefix(value, "0x"), "0")
+	if value == "" {
+		return "0"
+	}
+
+	return value
+}
+
+// settingMatches compares the wanted values with the start of the current ones, responses
+// often carry more than what is set
+func settingMatches(current []string, wanted []string) bool {
+	if len(current) < len(wanted) {
+		return false
+	}
+
+	for i, value := range wanted {
+		if normalizeSettingValue(current[i]) != normalizeSettingValue(value) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ensureModemSetting reads a setting and only writes it when it isn't already what we want,
+// some of these detach from the network or rescan all bands when written
+func ensureModemSetting(name string, queryCommand string, prefix string, wanted []string, setCommand string) error {
+	output, err := RunModemManagerCommand(queryCommand)
+	if err != nil {
+		return fmt.Errorf("unable to get %s from modem, error: %v", name, err)
+	}
+
+	current, found := modemSettingValues(output, prefix)
+	if found && settingMatches(current, wanted) {
+		zap.S().Infof("%s is up-to-date", name)
+		return nil
+	}
+
+	output, err = RunModemManagerCommand(setCommand)
+	if err != nil {
+		return fmt.Errorf("unable to set %s on modem, error: %v", name, err)
+	}
+
+	if !strings.Contains(output, "OK") {
+		return fmt.Errorf("%s rejected by modem, output: %s", name, output)
+	}
+
+	zap.S().Infof("%s set with %s", name, setCommand)
+	return nil
+}
+
+// ratSetting gives the query, its response prefix, the mode and the command setting it for
+// the radio access technology
+func ratSetting(vendor string, model string, rat string) (string, string, string, string, error) {
+	modes := map[string]string{}
+	queryCommand, prefix, setCommand := "", "", ""
+
+	switch {
+	case vendor == "Quectel":
+		modes = map[string]string{"auto": "0", "lte": "3"}
+		queryCommand, prefix, setCommand = "AT+QCFG=\"nwscanmode\"", "+QCFG: \"nwscanmode\",", "AT+QCFG=\"nwscanmode\",%s,1"
+	case vendor == "Telit" && strings.HasPrefix(model, "ME910C1"):
+		modes = map[string]string{"auto": "2", "catm": "0", "nbiot": "1"}
+		queryCommand, prefix, setCommand = "AT#WS46?", "#WS46:", "AT#WS46=%s"
+	case vendor == "Telit":
+		modes = map[string]string{"auto": "25", "lte": "28"}
+		queryCommand, prefix, setCommand = "AT+WS46?", "+WS46:", "AT+WS46=%s"
+	default:
+		return "", "", "", "", fmt.Errorf("rat lock is not supported on %s %s", vendor, model)
+	}
+
+	mode, ok := modes[strings.ToLower(rat)]
+	if !ok {
+		return "", "", "", "", fmt.Errorf("rat %s is not supported on %s %s", rat, vendor, model)
+	}
+
+	return queryCommand, prefix, mode, fmt.Sprintf(setCommand, mode), nil
+}
+
+// ConfigureNetworkLock applies NetworkLock. The operator goes last, a manual selection fails
+// when the operator can't be found on the bands and RAT left to the modem. A lock that can't be
+// applied is logged and the modem stays on whatever it had, it would rather be on the network
+// than off it for a setting that is only a preference.
+func (m *Modem) ConfigureNetworkLock() {
+	networkLock := Config.NetworkLock
+
+	if networkLock.Bands != "" {
+		wanted := strings.Split(networkLock.Bands, ",")
+		var err error
+		switch m.Vendor {
+		case "Quectel":
+			err = ensureModemSetting("band lock", "AT+QCFG=\"band\"", "+QCFG: \"band\",", wanted,
+				fmt.Sprintf("AT+QCFG=\"band\",%s,1", networkLock.Bands))
+		case "Telit":
+			err = ensureModemSetting("band lock", "AT#BND?", "#BND:", wanted, fmt.Sprintf("AT#BND=%s", networkLock.Bands))
+		default:
+			err = fmt.Errorf("band lock is not supported on %s", m.Vendor)
+		}
+		if err != nil {
+			zap.S().Errorf("unable to apply band lock, error: %v", err)
+		}
+	}
+
+	if networkLock.RAT != "" {
+		queryCommand, prefix, mode, setCommand, err := ratSetting(m.Vendor, m.Model, networkLock.RAT)
+		if err == nil {
+			err = ensureModemSetting("rat lock", queryCommand, prefix, []string{mode}, setCommand)
+		}
+		if err != nil {
+			zap.S().Errorf("unable to apply rat lock, error: %v", err)
+		}
+	}
+
+	// Only an optimisation, never worth keeping the modem off the network for
+	err := cellLock.Apply(m)
+	if err != nil {
+		zap.S().Errorf("unable to apply cell lock, error: %v", err)
+	}
+
+	// Numeric format, so +COPS? answers with the MCCMNC rather than the operator's name
+	output, err := RunModemManagerCommand("AT+COPS=3,2")
+	if err != nil || !strings.Contains(output, "OK") {
+		zap.S().Errorf("unable to set numeric operator format, output: %s, error: %v", output, err)
+		return
+	}
+
+	if networkLock.Operator == "" {
+		err = releaseOperatorLock()
+	} else {
+		err = ensureModemSetting("operator lock", "AT+COPS?", "+COPS:", []string{"1", "2", networkLock.Operator},
+			fmt.Sprintf("AT+COPS=1,2,\"%s\"", networkLock.Operator))
+		if err == nil {
+			recordOperatorLock(networkLock.Operator)
+		}
+	}
+	if err != nil {
+		zap.S().Errorf("unable to apply operator selection, error: %v", err)
+	}
+}
+
+func recordOperatorLock(operator string) {
+	if state.OperatorLock == operator {
+		return
+	}
+
+	state.OperatorLock = operator
+	if err := saveState(&state); err != nil {
+		zap.S().Errorf("unable to save operator lock, error: %v", err)
+	}
+}
+
+// operatorLockHeld tells if +COPS? still shows the manual selection of the operator we locked
+// the modem to
+func operatorLockHeld(output string, operator string) bool {
+	current, found := modemSettingValues(output, "+COPS:")
+	return found && operator != "" && settingMatches(current, []string{"1", "2", operator})
+}
+
+// releaseOperatorLock goes back to automatic selection after NetworkLock.Operator was removed.
+// Only a lock we applied is undone, an operator selected by hand stays.
+func releaseOperatorLock() error {
+	if state.OperatorLock == "" {
+		return nil
+	}
+
+	output, err := RunModemManagerCommand("AT+COPS?")
+	if err != nil {
+		return fmt.Errorf("unable to get operator selection from modem, error: %v", err)
+	}
+
+	if operatorLockHeld(output, state.OperatorLock) {
+		output, err = RunModemManagerCommand("AT+COPS=0")
+		if err != nil || !strings.Contains(output, "OK") {
+			return fmt.Errorf("unable to release operator lock, output: %s, error: %v", output, err)
+		}
+		zap.S().Infof("operator lock on %s released", state.OperatorLock)
+	}
+
+	recordOperatorLock("")
+	return nil
+}
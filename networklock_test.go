@@ -0,0 +1,24 @@
+package main
+
+import "testing"
+
+func TestOperatorLockHeld(t *testing.T) {
+	tests := []struct {
+		name     string
+		output   string
+		operator string
+		want     bool
+	}{
+		{"our lock", "+COPS: 1,2,\"26201\",7\r\nOK", "26201", true},
+		{"automatic", "+COPS: 0,2,\"26201\",7\r\nOK", "26201", false},
+		{"other operator chosen by hand", "+COPS: 1,2,\"26202\",7\r\nOK", "26201", false},
+		{"never locked", "+COPS: 1,2,\"26201\",7\r\nOK", "", false},
+		{"no answer", "ERROR", "26201", false},
+	}
+
+	for _, test := range tests {
+		if got := operatorLockHeld(test.output, test.operator); got != test.want {
+			t.Errorf("%s: operatorLockHeld = %t, want %t", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// adjtimex reports these while NTP hasn't synchronised the clock
+	timeStateError   = 5
+	timeStatusUnsync = 0x0040
+
+	// A modem whose clock was never set by the network reports 1980 or 2000
+	networkTimeMinimumYear = 2024
+)
+
+// parseModemTime reads the quoted time out of +CCLK: "yy/MM/dd,hh:mm:ss±zz" or
+// +QLTS: "yyyy/MM/dd,hh:mm:ss±zz,d". The time is local with the offset in quarter hours, which
+// for +QLTS only holds in mode 2, plain AT+QLTS answers with GMT next to the offset.
+func parseModemTime(output string) (time.Time, error) {
+	start := strings.Index(output, "\"")
+	end := strings.LastIndex(output, "\"")
+	if start < 0 || end <= start {
+		return time.Time{}, fmt.Errorf("no time in modem response %s", output)
+	}
+
+	fields := strings.Split(output[start+1:end], ",")
+	if len(fields) < 2 || len(fields[1]) < 9 {
+		return time.Time{}, fmt.Errorf("unexpected time %s", output[start:end+1])
+	}
+
+	date := strings.Split(fields[0], "/")
+	clock := strings.Split(fields[1][:8], ":")
+	if len(date) != 3 || len(clock) != 3 {
+		return time.Time{}, fmt.Errorf("unexpected time %s", output[start:end+1])
+	}
+
+	values := []int{}
+	for _, field := range append(date, clock...) {
+		value, err := strconv.Atoi(field)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("unexpected time %s", output[start:end+1])
+		}
+		values = append(values, value)
+	}
+
+	quarters, err := strconv.Atoi(fields[1][8:])
+	if err != nil {
+		return time.Time{}, fmt.Errorf("unexpected time zone in %s", output[start:end+1])
+	}
+
+	// Two digit years, an unset Telit clock starts at the GPS epoch in 1980
+	year := values[0]
+	if year < 70 {
+		year += 2000
+	} else if year < 100 {
+		year += 1900
+	}
+
+	zone := time.FixedZone("", quarters*15*60)
+	return time.Date(year, time.Month(values[1]), values[2], values[3], values[4], values[5], 0, zone).UTC(), nil
+}
+
+// ntpSynchronized tells whether something, systemd-timesyncd or chrony, keeps the clock in
+// sync, in which case the modem's time isn't needed
+func ntpSynchronized() bool {
+	timex := unix.Timex{}
+	state, err := unix.Adjtimex(&timex)
+	if err != nil {
+		return false
+	}
+
+	return state != timeStateError && timex.Status&timeStatusUnsync == 0
+}
+
+// EnableNetworkTime has the modem take time zone and time from the network (NITZ) and keep
+// its clock with them
+func (m *Modem) EnableNetworkTime() error {
+	output, err := RunModemManagerCommand("AT+CTZU?")
+	if err != nil {
+		return fmt.Errorf("unable to get network time update setting, error: %v", err)
+	}
+
+	if strings.Contains(output, "+CTZU: 1") {
+		return nil
+	}
+
+	output, err = RunModemManagerCommand("AT+CTZU=1")
+	if err != nil {
+		return fmt.Errorf("unable to enable network time update, error: %v", err)
+	}
+
+	if !strings.Contains(output, "OK") {
+		return fmt.Errorf("network time update rejected by modem, output: %s", output)
+	}
+
+	zap.S().Info("network time update enabled")
+	return nil
+}
+
+// ReadNetworkTime gets the time from the modem. Quectel keeps the last time the network sent
+// apart from its clock, that one is preferred since it can't be a clock that was never set.
+// Mode 2 has it in local time like +CCLK.
+func (m *Modem) ReadNetworkTime() (time.Time, error) {
+	commands := []string{"AT+CCLK?"}
+	if m.Vendor == "Quectel" {
+		commands = []string{"AT+QLTS=2", "AT+CCLK?"}
+	}
+
+	var lastErr error
+	for _, command := range commands {
+		output, err := RunModemManagerCommand(command)
+		if err != nil {
+			lastErr = fmt.Errorf("unable to read time with %s, error: %v", command, err)
+			continue
+		}
+
+		networkTime, err := parseModemTime(output)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		if networkTime.Year() < networkTimeMinimumYear {
+			lastErr = fmt.Errorf("modem clock was never set, it reports %s", networkTime)
+			continue
+		}
+
+		return networkTime, nil
+	}
+
+	return time.Time{}, lastErr
+}
+
+// recordTimeSource keeps where the system time came from in the hardware profile
+func recordTimeSource(source string) {
+	hardwareProfile, err := loadHardwareProfile()
+	if err != nil {
+		zap.S().Errorf("unable to load system.yaml, error: %v", err)
+		return
+	}
+
+	if hardwareProfile.TimeSource == source {
+		return
+	}
+
+	hardwareProfile.TimeSource = source
+	err = saveHardwareProfile(&hardwareProfile)
+	if err != nil {
+		zap.S().Errorf("unable to record time source, error: %v", err)
+	}
+}
+
+// SyncNetworkTime checks the system clock against the network's once the modem is registered.
+// Boards without an RTC start far in the past, so when NTP hasn't synchronised and the clock
+// is off by more than NetworkTimeMaxSkew it is set from the network if NetworkTimeSetClock
+// allows it.
+func (m *Modem) SyncNetworkTime() {
+	if ntpSynchronized() {
+		recordTimeSource("ntp")
+		return
+	}
+
+	networkTime, err := m.ReadNetworkTime()
+	if err != nil {
+		zap.S().Warnf("unable to get network time, error: %v", err)
+		return
+	}
+
+	skew := time.Until(networkTime)
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew <= time.Duration(Config.NetworkTimeMaxSkew)*time.Second {
+		return
+	}
+
+	if !Config.NetworkTimeSetClock {
+		zap.S().Warnf("system clock is %s off the network time %s and ntp hasn't synchronised", skew, networkTime)
+		return
+	}
+
+	timeval := unix.NsecToTimeval(networkTime.UnixNano())
+	err = unix.Settimeofday(&timeval)
+	if err != nil {
+		zap.S().Errorf("unable to set system clock from network time, error: %v", err)
+		return
+	}
+
+	zap.S().Infof("system clock was %s off, set to network time %s", skew, networkTime)
+	recordTimeSource("nitz")
+}
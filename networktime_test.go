@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseModemTime(t *testing.T) {
+	tests := []struct {
+		output string
+		want   time.Time
+		fails  bool
+	}{
+		{"\r\n+CCLK: \"24/05/06,10:20:30+08\"\r\n\r\nOK", time.Date(2024, 5, 6, 8, 20, 30, 0, time.UTC), false},
+		{"+CCLK: \"25/01/13,03:40:48-20\"", time.Date(2025, 1, 13, 8, 40, 48, 0, time.UTC), false},
+		// An unset Telit clock, still parsed so the caller can tell it was never set
+		{"+CCLK: \"80/01/06,00:00:10+00\"", time.Date(1980, 1, 6, 0, 0, 10, 0, time.UTC), false},
+		{"\r\n+QLTS: \"2025/01/13,03:40:48-20,0\"\r\n\r\nOK", time.Date(2025, 1, 13, 8, 40, 48, 0, time.UTC), false},
+		{"+QLTS: \"2024/12/31,23:30:00+36,1\"", time.Date(2024, 12, 31, 14, 30, 0, 0, time.UTC), false},
+		{"+QLTS: \"\"", time.Time{}, true},
+		{"ERROR", time.Time{}, true},
+		{"+CCLK: \"24/05/06,10:20\"", time.Time{}, true},
+		{"+CCLK: \"24/05/06,10:20:30+xx\"", time.Time{}, true},
+	}
+
+	for _, test := range tests {
+		got, err := parseModemTime(test.output)
+		if test.fails {
+			if err == nil {
+				t.Errorf("parseModemTime(%q) = %s, want an error", test.output, got)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("parseModemTime(%q) failed, error: %v", test.output, err)
+		} else if !got.Equal(test.want) {
+			t.Errorf("parseModemTime(%q) = %s, want %s", test.output, got, test.want)
+		}
+	}
+}
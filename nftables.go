@@ -0,0 +1,34 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// nftReplaceTable starts a ruleset that replaces one of our tables in the same transaction.
+// Declaring the table before deleting it keeps the delete from failing on the first run.
+func nftReplaceTable(family string, table string) string {
+	return fmt.Sprintf("table %s %s {}\ndelete table %s %s", family, table, family, table)
+}
+
+// applyNftRuleset hands the ruleset to nft on stdin, nothing is written where another user
+// could swap the file
+func applyNftRuleset(ruleset string) error {
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(ruleset)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("nft rejected the ruleset, error: %v, output: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return nil
+}
+
+func removeNftTable(family string, table string) error {
+	return applyNftRuleset(nftReplaceTable(family, table) + "\n")
+}
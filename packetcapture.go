@@ -0,0 +1,363 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	pcapngSectionHeader   = 0x0A0D0D0A
+	pcapngInterfaceHeader = 0x00000001
+	pcapngEnhancedPacket  = 0x00000006
+	pcapngByteOrderMagic  = 0x1A2B3C4D
+	pcapngOptionIfName    = 2
+
+	linkTypeEthernet = 1
+	linkTypeRaw      = 101
+)
+
+type CaptureResult struct {
+	Interface string
+	File      string
+	Started   time.Time
+	Packets   int
+	Bytes     int64
+	// The capture stopped at MaxBytes rather than Duration or MaxPackets
+	Truncated bool
+	Error     string
+}
+
+// compileCaptureFilter turns a tcpdump expression into classic BPF for the interface's link
+// type, tcpdump -ddd prints the instruction count followed by one "code jt jf k" per line
+func compileCaptureFilter(interfaceName string, filter string) ([]unix.SockFilter, error) {
+	if _, err := exec.LookPath("tcpdump"); err != nil {
+		return nil, fmt.Errorf("capture filter \"%s\" needs tcpdump, which isn't installed", filter)
+	}
+
+	output, err := RunShellCommand("tcpdump", "-i", interfaceName, "-ddd", filter)
+	if err != nil {
+		return nil, fmt.Errorf("unable to compile capture filter \"%s\" with tcpdump, error: %v", filter, err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	instructions := []unix.SockFilter{}
+	for _, line := range lines[1:] {
+		fields := strings.Fields(line)
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("unexpected bpf instruction %s", line)
+		}
+
+		values := [4]uint64{}
+		for i, field := range fields {
+			values[i], err = strconv.ParseUint(field, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("unexpected bpf instruction %s", line)
+			}
+		}
+		instructions = append(instructions, unix.SockFilter{
+			Code: uint16(values[0]),
+			Jt:   uint8(values[1]),
+			Jf:   uint8(values[2]),
+			K:    uint32(values[3]),
+		})
+	}
+
+	if len(instructions) == 0 {
+		return nil, fmt.Errorf("capture filter \"%s\" compiled to nothing", filter)
+	}
+
+	return instructions, nil
+}
+
+// captureLinkType maps the interface's hardware type to a pcap link type. ECM and most USB
+// network interfaces are ethernet, raw IP interfaces such as qmi_wwan in raw mode have no
+// link header at all.
+func captureLinkType(interfaceName string) uint16 {
+	content, err := os.ReadFile(fmt.Sprintf("/sys/class/net/%s/type", interfaceName))
+	if err != nil {
+		return linkTypeEthernet
+	}
+
+	hardwareType, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err == nil && (hardwareType == unix.ARPHRD_NONE || hardwareType == unix.ARPHRD_RAWIP) {
+		return linkTypeRaw
+	}
+
+	return linkTypeEthernet
+}
+
+// pcapngBlock frames a block body, blocks are padded to 32 bits and carry their length at
+// both ends
+func pcapngBlock(blockType uint32, body []byte) []byte {
+	padded := (len(body) + 3) &^ 3
+	length := uint32(12 + padded)
+
+	block := make([]byte, length)
+	binary.LittleEndian.PutUint32(block[0:], blockType)
+	binary.LittleEndian.PutUint32(block[4:], length)
+	copy(block[8:], body)
+	binary.LittleEndian.PutUint32(block[length-4:], length)
+	return block
+}
+
+func pcapngHeader(interfaceName string, linkType uint16, snapLength int) []byte {
+	section := make([]byte, 16)
+	binary.LittleEndian.PutUint32(section[0:], pcapngByteOrderMagic)
+	binary.LittleEndian.PutUint16(section[4:], 1) // version 1.0
+	binary.LittleEndian.PutUint16(section[6:], 0)
+	binary.LittleEndian.PutUint64(section[8:], 0xFFFFFFFFFFFFFFFF) // section length unknown
+
+	name := []byte(interfaceName)
+	description := make([]byte, 8+4+((len(name)+3)&^3)+4)
+	binary.LittleEndian.PutUint16(description[0:], linkType)
+	binary.LittleEndian.PutUint32(description[4:], uint32(snapLength))
+	binary.LittleEndian.PutUint16(description[8:], pcapngOptionIfName)
+	binary.LittleEndian.PutUint16(description[10:], uint16(len(name)))
+	copy(description[12:], name)
+	// opt_endofopt is the zeroed last four bytes
+
+	return append(pcapngBlock(pcapngSectionHeader, section), pcapngBlock(pcapngInterfaceHeader, description)...)
+}
+
+// pcapngPacket is an enhanced packet block with the default microsecond timestamp resolution
+func pcapngPacket(timestamp time.Time, data []byte, originalLength int) []byte {
+	microseconds := uint64(timestamp.UnixNano() / 1000)
+
+	body := make([]byte, 20+len(data))
+	binary.LittleEndian.PutUint32(body[0:], 0) // interface id
+	binary.LittleEndian.PutUint32(body[4:], uint32(microseconds>>32))
+	binary.LittleEndian.PutUint32(body[8:], uint32(microseconds))
+	binary.LittleEndian.PutUint32(body[12:], uint32(len(data)))
+	binary.LittleEndian.PutUint32(body[16:], uint32(originalLength))
+	copy(body[20:], data)
+
+	return pcapngBlock(pcapngEnhancedPacket, body)
+}
+
+// openCaptureSocket opens a packet socket that sees everything on the interface in both
+// directions. It starts out bound to no protocol so nothing is queued before the filter is
+// attached.
+func openCaptureSocket(interfaceName string, filter string) (int, error) {
+	state, err := getInterfaceState(interfaceName)
+	if err != nil {
+		return -1, err
+	}
+
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return -1, fmt.Errorf("unable to open packet socket, the daemon needs CAP_NET_RAW, error: %v", err)
+	}
+
+	if filter != "" {
+		instructions, err := compileCaptureFilter(interfaceName, filter)
+		if err != nil {
+			unix.Close(fd)
+			return -1, err
+		}
+
+		program := unix.SockFprog{Len: uint16(len(instructions)), Filter: &instructions[0]}
+		err = unix.SetsockoptSockFprog(fd, unix.SOL_SOCKET, unix.SO_ATTACH_FILTER, &program)
+		if err != nil {
+			unix.Close(fd)
+			return -1, fmt.Errorf("unable to attach capture filter, error: %v", err)
+		}
+	}
+
+	err = unix.Bind(fd, &unix.SockaddrLinklayer{Protocol: htons(unix.ETH_P_ALL), Ifindex: state.Index})
+	if err != nil {
+		unix.Close(fd)
+		return -1, err
+	}
+
+	return fd, nil
+}
+
+// capturePackets writes what crosses the interface to a pcapng file until the duration runs
+// out, MaxPackets were seen or the file would grow past MaxBytes
+func capturePackets(interfaceName string, config PacketCaptureConfig, path string) CaptureResult {
+	result := CaptureResult{Interface: interfaceName, File: path, Started: time.Now()}
+
+	fd, err := openCaptureSocket(interfaceName, config.Filter)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer unix.Close(fd)
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer file.Close()
+
+	header := pcapngHeader(interfaceName, captureLinkType(interfaceName), config.SnapLength)
+	_, err = file.Write(header)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.Bytes = int64(len(header))
+
+	deadline := result.Started.Add(time.Duration(config.Duration) * time.Second)
+	buffer := make([]byte, config.SnapLength)
+	for config.MaxPackets <= 0 || result.Packets < config.MaxPackets {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			break
+		}
+
+		// Wake up at least once a second so the deadline is kept on a quiet link
+		if remaining > time.Second {
+			remaining = time.Second
+		}
+		timeval := unix.NsecToTimeval(remaining.Nanoseconds())
+		err = unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &timeval)
+		if err != nil {
+			result.Error = err.Error()
+			return result
+		}
+
+		// With MSG_TRUNC the length is the packet's own, not what fitted in the buffer
+		length, _, err := unix.Recvfrom(fd, buffer, unix.MSG_TRUNC)
+		if errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EINTR) {
+			continue
+		}
+		if err != nil {
+			result.Error = err.Error()
+			return result
+		}
+
+		captured := length
+		if captured > len(buffer) {
+			captured = len(buffer)
+		}
+
+		block := pcapngPacket(time.Now(), buffer[:captured], length)
+		if result.Bytes+int64(len(block)) > config.MaxBytes {
+			result.Truncated = true
+			break
+		}
+
+		_, err = file.Write(block)
+		if err != nil {
+			result.Error = err.Error()
+			return result
+		}
+		result.Bytes += int64(len(block))
+		result.Packets++
+	}
+
+	return result
+}
+
+// PacketCapture captures on the modem interface when asked to, one capture at a time, into
+// the configured capture directory.
+type PacketCapture struct {
+	mutex     sync.Mutex
+	running   bool
+	requested bool
+	last      CaptureResult
+	watching  sync.Once
+}
+
+var packetCapture PacketCapture
+
+// Request asks for a capture on the next Manage
+func (p *PacketCapture) Request() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.requested = true
+}
+
+func (p *PacketCapture) watchSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR2)
+	for range signals {
+		zap.S().Info("packet capture requested")
+		p.Request()
+	}
+}
+
+func (p *PacketCapture) Last() CaptureResult {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.last
+}
+
+// Manage starts a requested capture on the modem interface
+func (p *PacketCapture) Manage(modemInterface string) {
+	p.watching.Do(func() {
+		if Config.PacketCapture.Filter != "" {
+			if _, err := exec.LookPath("tcpdump"); err != nil {
+				zap.S().Errorf("packet capture filter \"%s\" needs tcpdump, which isn't installed, captures will fail until it is",
+					Config.PacketCapture.Filter)
+			}
+		}
+		go p.watchSignal()
+	})
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.running || !p.requested {
+		return
+	}
+
+	config := Config.PacketCapture
+	if config.Duration <= 0 {
+		config.Duration = 30
+	}
+	if config.MaxBytes <= 0 {
+		config.MaxBytes = 10000000
+	}
+	if config.SnapLength <= 0 {
+		config.SnapLength = 262144
+	}
+	if config.Directory == "" {
+		config.Directory = "captures"
+	}
+
+	p.running = true
+	p.requested = false
+	go p.run(modemInterface, config)
+}
+
+func (p *PacketCapture) run(interfaceName string, config PacketCaptureConfig) {
+	path := filepath.Join(config.Directory, fmt.Sprintf("cm-capture_%s.pcapng", time.Now().Format("20060102-150405")))
+	zap.S().Infof("capturing on %s into %s for %d seconds", interfaceName, path, config.Duration)
+
+	var result CaptureResult
+	err := os.MkdirAll(config.Directory, 0700)
+	if err != nil {
+		result = CaptureResult{Interface: interfaceName, File: path, Started: time.Now(),
+			Error: fmt.Sprintf("unable to create capture directory %s, error: %v", config.Directory, err)}
+	} else {
+		result = capturePackets(interfaceName, config, path)
+	}
+	if result.Error != "" {
+		zap.S().Errorf("packet capture on %s failed, error: %s", interfaceName, result.Error)
+	} else if result.Truncated {
+		zap.S().Warnf("packet capture on %s stopped at %d bytes after %d packets", interfaceName, result.Bytes, result.Packets)
+	} else {
+		zap.S().Infof("packet capture on %s done, %d packets in %s", interfaceName, result.Packets, path)
+	}
+
+	p.mutex.Lock()
+	p.last = result
+	p.running = false
+	p.mutex.Unlock()
+}
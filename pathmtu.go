@@ -0,0 +1,232 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// Every IPv4 path has to carry this much, the search doesn't go lower
+	minimumPathMTU   = 576
+	ipv4HeaderLength = 20
+	pathMTUAttempts  = 2
+	// A black hole often goes away with the operator's routing, after this the interface gets
+	// its MTU back and the next diagnosis measures again
+	pathMTUHoldTime = 6 * time.Hour
+)
+
+type appliedMTU struct {
+	PathMTU int
+	// What the interface had before, the path MTU is measured up to it again
+	LinkMTU int
+	Expiry  time.Time
+}
+
+// Path MTUs applied by diagnosis, keyed by interface. They are kept so a reset interface gets
+// them back and a higher configured MTU doesn't undo them, until they expire.
+var appliedPathMTU = map[string]appliedMTU{}
+
+// pathMTUCeiling is the MTU an interface has without a measured path MTU, the configured one
+// or what it had before the path MTU was applied. 0 leaves the interface as it is.
+func pathMTUCeiling(interfaceName string) int {
+	if mtu := Config.InterfaceMTU[interfaceName]; mtu != 0 {
+		return mtu
+	}
+
+	return appliedPathMTU[interfaceName].LinkMTU
+}
+
+// wantedMTU gives the MTU from InterfaceMTU, or the measured path MTU if it is lower and
+// hasn't expired yet. An expired path MTU is forgotten.
+func wantedMTU(interfaceName string, now time.Time) int {
+	mtu := pathMTUCeiling(interfaceName)
+	applied, ok := appliedPathMTU[interfaceName]
+	if !ok {
+		return mtu
+	}
+
+	if now.After(applied.Expiry) {
+		zap.S().Infof("path mtu %d on %s expired, going back to %d", applied.PathMTU, interfaceName, mtu)
+		delete(appliedPathMTU, interfaceName)
+		return mtu
+	}
+
+	if mtu == 0 || applied.PathMTU < mtu {
+		return applied.PathMTU
+	}
+
+	return mtu
+}
+
+// applyConfiguredMTU sets the MTU from InterfaceMTU, or the measured path MTU if it is lower,
+// only touching the link when it differs
+func applyConfiguredMTU(interfaceName string) error {
+	mtu := wantedMTU(interfaceName, time.Now())
+	if mtu == 0 {
+		return nil
+	}
+
+	state, err := getInterfaceState(interfaceName)
+	if err != nil {
+		return err
+	}
+
+	if state.MTU == mtu {
+		return nil
+	}
+
+	zap.S().Infof("setting mtu on %s from %d to %d", interfaceName, state.MTU, mtu)
+	return setLinkMTU(interfaceName, mtu)
+}
+
+func ApplyInterfaceMTUs() {
+	interfaceNames := map[string]bool{}
+	for interfaceName := range Config.InterfaceMTU {
+		interfaceNames[interfaceName] = true
+	}
+	for interfaceName := range appliedPathMTU {
+		interfaceNames[interfaceName] = true
+	}
+
+	for interfaceName := range interfaceNames {
+		err := applyConfiguredMTU(interfaceName)
+		if err != nil && !errors.Is(err, errInterfaceNotFound) {
+			zap.S().Errorf("unable to apply mtu on %s, error: %v", interfaceName, err)
+		}
+	}
+}
+
+// probePathMTUSize sends an echo request of the given IP packet size with DF set. The socket
+// ignores the kernel's cached path MTU, so a size the path can't carry is simply lost, which
+// is exactly what a black hole does to the TLS handshake too.
+func probePathMTUSize(socket *icmpSocket, target net.IP, size int, sequence *uint16, timeout time.Duration) bool {
+	for attempt := 0; attempt < pathMTUAttempts; attempt++ {
+		*sequence++
+		_, err := socket.pingSize(target, *sequence, size-ipv4HeaderLength, timeout)
+		if err == nil {
+			return true
+		}
+		// Bigger than the interface itself, no point retrying
+		if errors.Is(err, unix.EMSGSIZE) {
+			return false
+		}
+	}
+
+	return false
+}
+
+// discoverPathMTU finds the largest packet that makes it to the target and back out of the
+// interface by bisecting between the IPv4 minimum and the interface MTU.
+func discoverPathMTU(interfaceName string, target string, timeout time.Duration) (int, error) {
+	state, err := getInterfaceState(interfaceName)
+	if err != nil {
+		return 0, err
+	}
+
+	ip := net.ParseIP(target).To4()
+	if ip == nil {
+		return 0, fmt.Errorf("path mtu target %s must be an ipv4 address", target)
+	}
+
+	socket, err := openIcmpSocket(interfaceName, false)
+	if err != nil {
+		return 0, err
+	}
+	defer socket.Close()
+
+	err = unix.SetsockoptInt(socket.fd, unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, unix.IP_PMTUDISC_PROBE)
+	if err != nil {
+		return 0, fmt.Errorf("unable to set dont fragment on probe socket, error: %v", err)
+	}
+
+	sequence := uint16(0)
+	if !probePathMTUSize(socket, ip, minimumPathMTU, &sequence, timeout) {
+		return 0, fmt.Errorf("%s doesn't answer even %d byte packets over %s", target, minimumPathMTU, interfaceName)
+	}
+
+	if probePathMTUSize(socket, ip, state.MTU, &sequence, timeout) {
+		return state.MTU, nil
+	}
+
+	low, high := minimumPathMTU, state.MTU
+	for high-low > 1 {
+		size := (low + high) / 2
+		if probePathMTUSize(socket, ip, size, &sequence, timeout) {
+			low = size
+		} else {
+			high = size
+		}
+	}
+
+	return low, nil
+}
+
+// checkPathMTU measures the path MTU for Diagnose and lowers the interface MTU to it when
+// PathMTUAutoApply is set. A path MTU applied before is measured again from the interface's
+// own MTU, so the path getting better is noticed.
+func (m *Modem) checkPathMTU() {
+	m.DiagnosticProperties.PathMTU = 0
+	m.DiagnosticProperties.PathMTUApplied = false
+
+	state, err := getInterfaceState(m.InterfaceName)
+	if err != nil {
+		zap.S().Errorf("unable to read mtu of %s, error: %v", m.InterfaceName, err)
+		return
+	}
+	m.DiagnosticProperties.InterfaceMTU = state.MTU
+
+	applied, reprobe := appliedPathMTU[m.InterfaceName]
+	ceiling := pathMTUCeiling(m.InterfaceName)
+	if reprobe && ceiling > state.MTU {
+		err = setLinkMTU(m.InterfaceName, ceiling)
+		if err != nil {
+			zap.S().Errorf("unable to raise mtu on %s to measure the path again, error: %v", m.InterfaceName, err)
+			return
+		}
+		state.MTU = ceiling
+	}
+
+	pathMTU, err := discoverPathMTU(m.InterfaceName, Config.PathMTUTarget, time.Duration(Config.OtherPingTimeout)*time.Second)
+	if err != nil {
+		zap.S().Errorf("unable to measure path mtu on %s, error: %v", m.InterfaceName, err)
+		if reprobe && applied.PathMTU < state.MTU {
+			// Nothing learned, the interface keeps the path MTU it had
+			err = setLinkMTU(m.InterfaceName, applied.PathMTU)
+			if err != nil {
+				zap.S().Errorf("unable to restore path mtu, error: %v", err)
+			}
+			m.DiagnosticProperties.InterfaceMTU = applied.PathMTU
+		}
+		return
+	}
+	m.DiagnosticProperties.PathMTU = pathMTU
+	m.DiagnosticProperties.InterfaceMTU = state.MTU
+	delete(appliedPathMTU, m.InterfaceName)
+
+	if pathMTU >= state.MTU {
+		return
+	}
+
+	zap.S().Warnf("path mtu on %s is %d, below the interface mtu %d", m.InterfaceName, pathMTU, state.MTU)
+	if !Config.PathMTUAutoApply {
+		return
+	}
+
+	err = setLinkMTU(m.InterfaceName, pathMTU)
+	if err != nil {
+		zap.S().Errorf("unable to apply path mtu, error: %v", err)
+		return
+	}
+	appliedPathMTU[m.InterfaceName] = appliedMTU{
+		PathMTU: pathMTU,
+		LinkMTU: state.MTU,
+		Expiry:  time.Now().Add(pathMTUHoldTime),
+	}
+	m.DiagnosticProperties.PathMTUApplied = true
+	m.DiagnosticProperties.InterfaceMTU = pathMTU
+}
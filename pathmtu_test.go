@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWantedMTU(t *testing.T) {
+	savedConfig, savedApplied := Config, appliedPathMTU
+	defer func() { Config, appliedPathMTU = savedConfig, savedApplied }()
+
+	now := time.Date(2026, 3, 14, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name        string
+		configured  int
+		applied     *appliedMTU
+		want        int
+		wantApplied bool
+	}{
+		{"nothing set", 0, nil, 0, false},
+		{"configured", 1400, nil, 1400, false},
+		{"path mtu below configured", 1400, &appliedMTU{PathMTU: 1280, LinkMTU: 1400, Expiry: now.Add(time.Hour)}, 1280, true},
+		{"path mtu above configured", 1200, &appliedMTU{PathMTU: 1280, LinkMTU: 1500, Expiry: now.Add(time.Hour)}, 1200, true},
+		{"path mtu only", 0, &appliedMTU{PathMTU: 1280, LinkMTU: 1500, Expiry: now.Add(time.Hour)}, 1280, true},
+		// The interface goes back to what it had before, not to the lowered MTU
+		{"expired", 0, &appliedMTU{PathMTU: 1280, LinkMTU: 1500, Expiry: now.Add(-time.Second)}, 1500, false},
+		{"expired with configured", 1400, &appliedMTU{PathMTU: 1280, LinkMTU: 1500, Expiry: now.Add(-time.Second)}, 1400, false},
+	}
+
+	for _, test := range tests {
+		Config.InterfaceMTU = map[string]int{}
+		if test.configured != 0 {
+			Config.InterfaceMTU["wwan0"] = test.configured
+		}
+		appliedPathMTU = map[string]appliedMTU{}
+		if test.applied != nil {
+			appliedPathMTU["wwan0"] = *test.applied
+		}
+
+		if got := wantedMTU("wwan0", now); got != test.want {
+			t.Errorf("%s: wantedMTU = %d, want %d", test.name, got, test.want)
+		}
+		if _, ok := appliedPathMTU["wwan0"]; ok != test.wantApplied {
+			t.Errorf("%s: path mtu kept %t, want %t", test.name, ok, test.wantApplied)
+		}
+	}
+}
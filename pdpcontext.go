@@ -0,0 +1,671 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"go.uber.org/zap"
+)
+
+type PDPContext struct {
+	ContextID int
+	PDPType   string
+	APN       string
+}
+
+// parseCgdcont reads the response to AT+CGDCONT? which has one line per defined context, e.g.
+// +CGDCONT: 1,"IPV4V6","super","0.0.0.0",0,0
+func parseCgdcont(output string) []PDPContext {
+	contexts := []PDPContext{}
+
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "+CGDCONT:") {
+			continue
+		}
+
+		fields := strings.Split(strings.TrimSpace(strings.TrimPrefix(line, "+CGDCONT:")), ",")
+		if len(fields) < 3 {
+			continue
+		}
+
+		contextId, err := strconv.Atoi(strings.TrimSpace(fields[0]))
+		if err != nil {
+			continue
+		}
+
+		contexts = append(contexts, PDPContext{
+			ContextID: contextId,
+			PDPType:   strings.ToUpper(strings.Trim(strings.TrimSpace(fields[1]), "\"")),
+			APN:       strings.Trim(strings.TrimSpace(fields[2]), "\""),
+		})
+	}
+
+	return contexts
+}
+
+func findPDPContext(contexts []PDPContext, contextId int) (PDPContext, bool) {
+	for _, context := range contexts {
+		if context.ContextID == contextId {
+			return context, true
+		}
+	}
+
+	return PDPContext{}, false
+}
+
+// pdpContextMatches is true when the modem has the context set up the way the profile asks.
+// Networks may echo the APN back in a different case so that comparison is case-insensitive.
+func pdpContextMatches(contexts []PDPContext, apn string, profile ApnProfile) bool {
+	context, ok := findPDPContext(contexts, profile.ContextID)
+	if !ok {
+		return false
+	}
+
+	return strings.EqualFold(context.APN, apn) && context.PDPType == profile.PDPType
+}
+
+func authTypeCode(authType string) (int, error) {
+	switch authType {
+	case "", "none":
+		return 0, nil
+	case "pap":
+		return 1, nil
+	case "chap":
+		return 2, nil
+	}
+
+	return 0, fmt.Errorf("unknown apn auth type %s", authType)
+}
+
+// Quectel keeps the APN and credentials together in AT+QICSGP and wants its own numbering
+// for the PDP type, Telit has AT#PDPAUTH and anything else gets the 3GPP AT+CGAUTH.
+func apnAuthCommand(vendor string, apn string, profile ApnProfile) (string, error) {
+	authCode, err := authTypeCode(profile.AuthType)
+	if err != nil {
+		return "", err
+	}
+
+	switch vendor {
+	case "Quectel":
+		contextType := 3
+		switch profile.PDPType {
+		case "IP":
+			contextType = 1
+		case "IPV6":
+			contextType = 2
+		}
+		return fmt.Sprintf("AT+QICSGP=%d,%d,\"%s\",\"%s\",\"%s\",%d",
+			profile.ContextID, contextType, apn, profile.Username, profile.Password, authCode), nil
+	case "Telit":
+		return fmt.Sprintf("AT#PDPAUTH=%d,%d,\"%s\",\"%s\"",
+			profile.ContextID, authCode, profile.Username, profile.Password), nil
+	}
+
+	if authCode == 0 {
+		return fmt.Sprintf("AT+CGAUTH=%d,0", profile.ContextID), nil
+	}
+
+	return fmt.Sprintf("AT+CGAUTH=%d,%d,\"%s\",\"%s\"",
+		profile.ContextID, authCode, profile.Username, profile.Password), nil
+}
+
+// redactApnCredentials hides the username and password in anything that may carry the
+// authentication command, ModemManager's errors and modems echoing it back do
+func redactApnCredentials(text string, profile ApnProfile) string {
+	for _, credential := range []string{profile.Password, profile.Username} {
+		if credential != "" {
+			text = strings.ReplaceAll(text, "\""+credential+"\"", "\"***\"")
+		}
+	}
+
+	return text
+}
+
+type PDPContextStatus struct {
+	APN           string
+	ContextID     int
+	Active        bool
+	InterfaceName string
+	// Why the context carries no traffic even when active, empty once it has its interface
+	Unusable   string
+	Connection bool
+	Latency    int
+}
+
+// parseCgact reads the activation state of each context from AT+CGACT?, e.g.
+// +CGACT: 1,1
+func parseCgact(output string) map[int]bool {
+	states := map[int]bool{}
+
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "+CGACT:") {
+			continue
+		}
+
+		fields := strings.Split(strings.TrimSpace(strings.TrimPrefix(line, "+CGACT:")), ",")
+		if len(fields) < 2 {
+			continue
+		}
+
+		contextId, err := strconv.Atoi(strings.TrimSpace(fields[0]))
+		if err != nil {
+			continue
+		}
+
+		states[contextId] = strings.TrimSpace(fields[1]) == "1"
+	}
+
+	return states
+}
+
+// parseEcmState reads the Telit #ECM: <instance>,<state> response. There is only instance 0,
+// which AT#ECM=0,<cid> brings up on whichever context it is given.
+func parseEcmState(output string) bool {
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "#ECM:") {
+			continue
+		}
+
+		fields := strings.Split(strings.TrimSpace(strings.TrimPrefix(line, "#ECM:")), ",")
+		if len(fields) >= 2 && strings.TrimSpace(fields[0]) == "0" && strings.TrimSpace(fields[1]) == "1" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// pdpActivateCommand brings up the data session on the current APN's context. Quectel dials
+// context 1 on its own once usbnet is set, any other context has to be attached to the
+// network device first.
+func (m *Modem) pdpActivateCommand() string {
+	contextId := Config.ApnProfile(m.CurrentApn()).ContextID
+	if m.Vendor == "Quectel" && contextId == 1 {
+		return "AT"
+	}
+
+	return fmt.Sprintf(m.PDPActivateCommand, contextId)
+}
+
+// pdpContextActive reads the PDPStatusCommand response. On Quectel that is +CGACT?, where the
+// current APN's context has to be the active one, Telit reports the ECM session itself.
+func (m *Modem) pdpContextActive(output string) bool {
+	if m.Vendor == "Telit" {
+		return parseEcmState(output)
+	}
+
+	return parseCgact(output)[Config.ApnProfile(m.CurrentApn()).ContextID]
+}
+
+func additionalContextProfile(context PDPContextConfig) ApnProfile {
+	return context.Profile.withDefaults()
+}
+
+func additionalContextName(context PDPContextConfig) string {
+	if context.Name != "" {
+		return context.Name
+	}
+
+	return context.APN
+}
+
+// Interfaces of extra contexts that were found missing, so that is only logged once
+var missingContextInterfaces = map[string]bool{}
+
+// validateContextRoutingTable keeps a context's table apart from the policy routing tables
+// and the other contexts' tables, syncRules on both sides would remove each other's rules
+func validateContextRoutingTable(context PDPContextConfig, usedTables map[int]string) error {
+	if context.RoutingTable == 0 {
+		return nil
+	}
+
+	name := additionalContextName(context)
+	if owner, ok := usedTables[context.RoutingTable]; ok {
+		return fmt.Errorf("pdp context %s uses routing table %d which is already used by %s", name, context.RoutingTable, owner)
+	}
+
+	if !Config.PolicyRouting {
+		return nil
+	}
+
+	for interfaceName := range Config.NetworkPriority {
+		if policyRoutingTable(interfaceName) == context.RoutingTable {
+			return fmt.Errorf("pdp context %s uses routing table %d which is the policy routing table of %s",
+				name, context.RoutingTable, interfaceName)
+		}
+	}
+
+	return nil
+}
+
+// contextUnusable tells why an extra context can't carry traffic, empty when it has its own
+// interface. The modem has to be able to run several contexts, and the interface has to exist,
+// which takes setting up a second network endpoint on the modem. Traffic of the main interface
+// never goes through another context, so until then the context is up on the modem only.
+func (m *Modem) contextUnusable(context PDPContextConfig) string {
+	if context.InterfaceName == "" {
+		return "no interface configured"
+	}
+
+	if !m.MultipleContexts {
+		return fmt.Sprintf("%s %s has one network interface for the main context only", m.Vendor, m.Model)
+	}
+
+	_, err := getInterfaceState(context.InterfaceName)
+	if errors.Is(err, errInterfaceNotFound) {
+		if !missingContextInterfaces[context.InterfaceName] {
+			zap.S().Errorf("interface %s of pdp context %s doesn't exist, the context carries no traffic until the modem exposes it",
+				context.InterfaceName, additionalContextName(context))
+			missingContextInterfaces[context.InterfaceName] = true
+		}
+		return fmt.Sprintf("interface %s doesn't exist", context.InterfaceName)
+	}
+
+	delete(missingContextInterfaces, context.InterfaceName)
+	return ""
+}
+
+// ConfigureAdditionalContexts defines every extra PDP context from the configuration. They
+// each need their own context id so they don't overwrite the main APN.
+func (m *Modem) ConfigureAdditionalContexts() error {
+	mainContextId := Config.ApnProfile(m.CurrentApn()).ContextID
+	usedContextIds := map[int]string{mainContextId: m.CurrentApn()}
+	usedTables := map[int]string{}
+
+	for _, context := range Config.PDPContexts {
+		profile := additionalContextProfile(context)
+		name := additionalContextName(context)
+
+		if profile.ContextID == 0 {
+			return fmt.Errorf("pdp context %s needs a context id", name)
+		}
+
+		if owner, ok := usedContextIds[profile.ContextID]; ok {
+			return fmt.Errorf("pdp context %s uses context id %d which is already used by %s", name, profile.ContextID, owner)
+		}
+		usedContextIds[profile.ContextID] = name
+
+		if context.InterfaceName != "" && !m.MultipleContexts {
+			zap.S().Errorf("%s %s can't give pdp context %s its own interface, it will carry no traffic",
+				m.Vendor, m.Model, name)
+		}
+
+		err := validateContextRoutingTable(context, usedTables)
+		if err != nil {
+			return err
+		}
+		if context.RoutingTable != 0 {
+			usedTables[context.RoutingTable] = name
+		}
+
+		err = m.configurePDPContext(context.APN, profile)
+		if err != nil {
+			return fmt.Errorf("unable to configure pdp context %s, error: %v", name, err)
+		}
+	}
+
+	return nil
+}
+
+// ActivateAdditionalContexts brings up the extra contexts once the main data session is up.
+// Failures are only logged, the main APN is what the conductor cares about.
+func (m *Modem) ActivateAdditionalContexts() {
+	if len(Config.PDPContexts) == 0 {
+		return
+	}
+
+	output, err := RunModemManagerCommand("AT+CGACT?")
+	if err != nil {
+		zap.S().Errorf("unable to read pdp context state, error: %v", err)
+		return
+	}
+	states := parseCgact(output)
+
+	for _, context := range Config.PDPContexts {
+		err := m.activateAdditionalContext(context, states)
+		if err != nil {
+			zap.S().Errorf("unable to activate pdp context %s, error: %v", additionalContextName(context), err)
+		}
+	}
+}
+
+func (m *Modem) activateAdditionalContext(context PDPContextConfig, states map[int]bool) error {
+	profile := additionalContextProfile(context)
+
+	if !states[profile.ContextID] {
+		output, err := RunModemManagerCommand(fmt.Sprintf("AT+CGACT=1,%d", profile.ContextID))
+		if err != nil {
+			return err
+		}
+
+		if !strings.Contains(output, "OK") {
+			return fmt.Errorf("activation rejected, output: %s", output)
+		}
+	}
+
+	if m.contextUnusable(context) != "" {
+		return nil
+	}
+
+	return routeContextInterface(context)
+}
+
+// routeContextInterface gives the interface of a context its own routing table, so traffic
+// sourced from its addresses or bound to it leaves through its own APN instead of the default
+// route. The routes the DHCP client put in the main table are copied there, with a link
+// default route standing in until the lease brings a gateway.
+func routeContextInterface(context PDPContextConfig) error {
+	err := setLinkUp(context.InterfaceName)
+	if err != nil {
+		return err
+	}
+
+	if context.RoutingTable == 0 {
+		return nil
+	}
+
+	state, err := getInterfaceState(context.InterfaceName)
+	if err != nil {
+		return err
+	}
+
+	hasDefault := false
+	for _, route := range state.Routes {
+		if route.IsDefault() && route.Table == syscall.RT_TABLE_MAIN && route.Destination.IP.To4() != nil {
+			hasDefault = true
+		}
+	}
+
+	if !hasDefault {
+		defaultRoute := InterfaceRoute{
+			Destination: net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)},
+			Table:       context.RoutingTable,
+		}
+		err = replaceRoute(defaultRoute, state.Index)
+		if err != nil {
+			return linkControlError("add default route in its table for", context.InterfaceName, err)
+		}
+	}
+
+	return syncInterfacePolicyRouting(context.InterfaceName, context.RoutingTable)
+}
+
+// CheckAdditionalContexts records whether each extra context is still active and, when it has
+// its own interface, whether it reaches the internet. A context without one is reported
+// unusable. Dropped contexts get re-activated.
+func (m *Modem) CheckAdditionalContexts() {
+	if len(Config.PDPContexts) == 0 {
+		return
+	}
+
+	// A failed read keeps the last statuses rather than reporting every context gone
+	output, err := RunModemManagerCommand("AT+CGACT?")
+	if err != nil {
+		zap.S().Errorf("unable to read pdp context state, error: %v", err)
+		return
+	}
+	states := parseCgact(output)
+	statuses := map[string]PDPContextStatus{}
+
+	for _, context := range Config.PDPContexts {
+		profile := additionalContextProfile(context)
+		name := additionalContextName(context)
+
+		status := PDPContextStatus{
+			APN:           context.APN,
+			ContextID:     profile.ContextID,
+			Active:        states[profile.ContextID],
+			InterfaceName: context.InterfaceName,
+			Unusable:      m.contextUnusable(context),
+		}
+
+		if !status.Active {
+			zap.S().Infof("pdp context %s is down, activating it again", name)
+			err := m.activateAdditionalContext(context, states)
+			if err != nil {
+				zap.S().Errorf("unable to activate pdp context %s, error: %v", name, err)
+			}
+		} else if status.Unusable == "" {
+			latency, err := checkInterfaceHealth(context.InterfaceName, Config.PingTimeout)
+			if err != nil {
+				zap.S().Errorf("pdp context %s has no internet, error: %v", name, err)
+			}
+			status.Connection = err == nil
+			status.Latency = latency
+		}
+
+		statuses[name] = status
+	}
+
+	m.MonitoringProperties.PDPContexts = statuses
+}
+
+type PDPAddressing struct {
+	Addresses []string
+	Gateway   string
+	DNS       []string
+}
+
+// decodeModemAddress turns the way modems print addresses into something net.ParseIP
+// understands. Besides the usual forms, many firmwares print IPv6 as 16 dotted decimal octets
+// and append the subnet mask to the address, e.g. 10.1.2.3.255.255.255.0
+func decodeModemAddress(value string) string {
+	value = strings.Trim(strings.TrimSpace(value), "\"")
+	if value == "" {
+		return ""
+	}
+
+	if ip := net.ParseIP(value); ip != nil {
+		if ip.IsUnspecified() {
+			return ""
+		}
+		return ip.String()
+	}
+
+	octets := strings.Split(value, ".")
+	bytes := make([]byte, 0, len(octets))
+	for _, octet := range octets {
+		number, err := strconv.Atoi(octet)
+		if err != nil || number < 0 || number > 255 {
+			return ""
+		}
+		bytes = append(bytes, byte(number))
+	}
+
+	var ip net.IP
+	switch len(bytes) {
+	case 4, 8:
+		ip = net.IP(bytes[:4])
+	case 16, 32:
+		ip = net.IP(bytes[:16])
+	default:
+		return ""
+	}
+
+	if ip.IsUnspecified() {
+		return ""
+	}
+
+	return ip.String()
+}
+
+// splitModemFields splits a response line on commas that aren't inside quotes
+func splitModemFields(line string) []string {
+	fields := []string{}
+	quoted := false
+	start := 0
+
+	for i, char := range line {
+		switch char {
+		case '"':
+			quoted = !quoted
+		case ',':
+			if !quoted {
+				fields = append(fields, strings.TrimSpace(line[start:i]))
+				start = i + 1
+			}
+		}
+	}
+
+	return append(fields, strings.TrimSpace(line[start:]))
+}
+
+// parseCgpaddr reads the addresses of a context from AT+CGPADDR=<cid>, e.g.
+// +CGPADDR: 1,"10.1.2.3","254.128.0.0.0.0.0.0.0.0.0.0.0.0.0.1"
+func parseCgpaddr(output string, contextId int) []string {
+	addresses := []string{}
+
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "+CGPADDR:") {
+			continue
+		}
+
+		fields := splitModemFields(strings.TrimSpace(strings.TrimPrefix(line, "+CGPADDR:")))
+		if id, err := strconv.Atoi(fields[0]); err != nil || id != contextId {
+			continue
+		}
+
+		for _, field := range fields[1:] {
+			if address := decodeModemAddress(field); address != "" {
+				addresses = append(addresses, address)
+			}
+		}
+	}
+
+	return addresses
+}
+
+// parseCgcontrdp reads the dynamic parameters the network handed out from AT+CGCONTRDP=<cid>.
+// There is one line per bearer, a dual stack context gives one for each family:
+// +CGCONTRDP: <cid>,<bearer>,<apn>,<address and mask>,<gateway>,<dns1>,<dns2>,...
+func parseCgcontrdp(output string, contextId int) PDPAddressing {
+	addressing := PDPAddressing{}
+
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "+CGCONTRDP:") {
+			continue
+		}
+
+		fields := splitModemFields(strings.TrimSpace(strings.TrimPrefix(line, "+CGCONTRDP:")))
+		if id, err := strconv.Atoi(fields[0]); err != nil || id != contextId {
+			continue
+		}
+
+		if len(fields) > 3 {
+			if address := decodeModemAddress(fields[3]); address != "" {
+				addressing.Addresses = append(addressing.Addresses, address)
+			}
+		}
+
+		if len(fields) > 4 && addressing.Gateway == "" {
+			addressing.Gateway = decodeModemAddress(fields[4])
+		}
+
+		for i := 5; i < len(fields) && i < 7; i++ {
+			if dns := decodeModemAddress(fields[i]); dns != "" {
+				addressing.DNS = append(addressing.DNS, dns)
+			}
+		}
+	}
+
+	return addressing
+}
+
+// ReadPDPAddressing asks the modem what the network assigned to the main context
+func (m *Modem) ReadPDPAddressing() (PDPAddressing, error) {
+	contextId := Config.ApnProfile(m.CurrentApn()).ContextID
+
+	output, err := RunModemManagerCommand(fmt.Sprintf("AT+CGPADDR=%d", contextId))
+	if err != nil {
+		return PDPAddressing{}, fmt.Errorf("unable to get pdp address from modem, error: %v", err)
+	}
+	addresses := parseCgpaddr(output, contextId)
+
+	output, err = RunModemManagerCommand(fmt.Sprintf("AT+CGCONTRDP=%d", contextId))
+	if err != nil {
+		return PDPAddressing{}, fmt.Errorf("unable to get pdp parameters from modem, error: %v", err)
+	}
+	addressing := parseCgcontrdp(output, contextId)
+
+	// CGPADDR is supported more widely, only fall back to what CGCONTRDP reported
+	if len(addresses) > 0 {
+		addressing.Addresses = addresses
+	}
+
+	return addressing, nil
+}
+
+func interfaceAddresses(interfaceName string) ([]string, error) {
+	state, err := getInterfaceState(interfaceName)
+	if err != nil {
+		return nil, err
+	}
+
+	addresses := []string{}
+	for _, address := range state.Addresses {
+		addresses = append(addresses, address.IP.String())
+	}
+
+	return addresses, nil
+}
+
+// pdpAddressMatches checks the IPv4 address the network gave the context is the one the kernel
+// has on the interface. Telit ECM can get stuck holding an address from an older session which
+// looks fine on the modem side but never passes traffic. IPv6 is left out, the modem only
+// learns the interface identifier and the kernel builds its own address from the prefix.
+func pdpAddressMatches(pdpAddresses []string, kernelAddresses []string) bool {
+	for _, pdpAddress := range pdpAddresses {
+		ip := net.ParseIP(pdpAddress)
+		if ip == nil || ip.To4() == nil {
+			continue
+		}
+
+		found := false
+		for _, kernelAddress := range kernelAddresses {
+			if kernelAddress == pdpAddress {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// UpdatePDPAddressing records the assigned addressing in monitoring and tells if the kernel agrees
+func (m *Modem) UpdatePDPAddressing() (bool, error) {
+	addressing, err := m.ReadPDPAddressing()
+	if err != nil {
+		return false, err
+	}
+
+	m.MonitoringProperties.CellularAddresses = addressing.Addresses
+	m.MonitoringProperties.CellularGateway = addressing.Gateway
+	m.MonitoringProperties.CellularDNS = addressing.DNS
+	setInterfaceNameservers(m.InterfaceName, addressing.DNS)
+
+	kernelAddresses, err := interfaceAddresses(m.InterfaceName)
+	if err != nil {
+		return false, fmt.Errorf("unable to get addresses of %s, error: %v", m.InterfaceName, err)
+	}
+
+	matches := pdpAddressMatches(addressing.Addresses, kernelAddresses)
+	if !matches {
+		zap.S().Warnf("network assigned %v but %s has %v", addressing.Addresses, m.InterfaceName, kernelAddresses)
+	}
+
+	return matches, nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRedactApnCredentials(t *testing.T) {
+	profile := ApnProfile{ContextID: 1, PDPType: "IP", AuthType: "chap", Username: "fleet", Password: "s3cr3t"}
+
+	for _, vendor := range []string{"Quectel", "Telit", "Sierra"} {
+		command, err := apnAuthCommand(vendor, "iot.example", profile)
+		if err != nil {
+			t.Fatalf("unable to build %s auth command, error: %v", vendor, err)
+		}
+
+		failure := "unable to get response from modem for command " + command + ", error: timeout"
+		redacted := redactApnCredentials(failure, profile)
+		if strings.Contains(redacted, profile.Password) || strings.Contains(redacted, profile.Username) {
+			t.Errorf("%s credentials left in %s", vendor, redacted)
+		}
+		if !strings.Contains(redacted, "iot.example") && vendor == "Quectel" {
+			t.Errorf("apn redacted from %s", redacted)
+		}
+	}
+}
+
+func TestParseEcmState(t *testing.T) {
+	tests := []struct {
+		output string
+		want   bool
+	}{
+		{"\r\n#ECM: 0,1\r\n\r\nOK", true},
+		{"#ECM: 0,0\r\nOK", false},
+		{"#ECM: 1,1\r\nOK", false},
+		{"ERROR", false},
+	}
+
+	for _, test := range tests {
+		if got := parseEcmState(test.output); got != test.want {
+			t.Errorf("parseEcmState(%q) = %t, want %t", test.output, got, test.want)
+		}
+	}
+}
+
+func TestPdpActivation(t *testing.T) {
+	saved := Config
+	defer func() { Config = saved }()
+
+	tests := []struct {
+		vendor      string
+		contextId   int
+		wantCommand string
+		status      string
+		wantActive  bool
+	}{
+		{"Quectel", 1, "AT", "+CGACT: 1,1\r\n+CGACT: 3,0\r\nOK", true},
+		{"Quectel", 3, "AT+QNETDEVCTL=1,3,1", "+CGACT: 1,1\r\n+CGACT: 3,0\r\nOK", false},
+		{"Quectel", 3, "AT+QNETDEVCTL=1,3,1", "+CGACT: 1,0\r\n+CGACT: 3,1\r\nOK", true},
+		{"Telit", 1, "AT#ECM=0,1", "#ECM: 0,1\r\nOK", true},
+		{"Telit", 3, "AT#ECM=0,3", "#ECM: 0,1\r\nOK", true},
+		{"Telit", 3, "AT#ECM=0,3", "#ECM: 0,0\r\nOK", false},
+	}
+
+	for _, test := range tests {
+		Config = Configuration{APN: "iot.example", APNProfiles: map[string]ApnProfile{"iot.example": {ContextID: test.contextId}}}
+		modem := Modem{Vendor: test.vendor}
+		updateModemCommands(test.vendor, "LE910C4-EU", &modem)
+
+		if command := modem.pdpActivateCommand(); command != test.wantCommand {
+			t.Errorf("%s context %d activated with %s, want %s", test.vendor, test.contextId, command, test.wantCommand)
+		}
+		if active := modem.pdpContextActive(test.status); active != test.wantActive {
+			t.Errorf("%s context %d active in %q = %t, want %t", test.vendor, test.contextId, test.status, active, test.wantActive)
+		}
+	}
+}
+
+func TestContextUnusable(t *testing.T) {
+	tests := []struct {
+		name             string
+		multipleContexts bool
+		interfaceName    string
+		wantUsable       bool
+	}{
+		{"no interface", true, "", false},
+		{"single context modem", false, "lo", false},
+		{"missing interface", true, "wwan-missing", false},
+		{"own interface", true, "lo", true},
+	}
+
+	for _, test := range tests {
+		m := Modem{Vendor: "Quectel", Model: "RM500Q", MultipleContexts: test.multipleContexts}
+		context := PDPContextConfig{Name: "management", InterfaceName: test.interfaceName}
+		if unusable := m.contextUnusable(context); (unusable == "") != test.wantUsable {
+			t.Errorf("%s: unusable %q, want usable %t", test.name, unusable, test.wantUsable)
+		}
+	}
+}
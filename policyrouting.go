@@ -0,0 +1,318 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"syscall"
+
+	"go.uber.org/zap"
+)
+
+// Routing rule attributes and action from linux/fib_rules.h, neither syscall nor x/sys has them
+const (
+	fraSrc        = 2
+	fraPriority   = 6
+	fraTable      = 15
+	fraOifname    = 17
+	frActToTable  = 1
+	fibRuleHdrLen = 12
+)
+
+type RoutingRule struct {
+	Family          int
+	Priority        int
+	Table           int
+	Source          *net.IPNet
+	OutputInterface string
+}
+
+func (r RoutingRule) matches(other RoutingRule) bool {
+	if r.Family != other.Family || r.Priority != other.Priority || r.Table != other.Table ||
+		r.OutputInterface != other.OutputInterface {
+		return false
+	}
+
+	if r.Source == nil || other.Source == nil {
+		return r.Source == nil && other.Source == nil
+	}
+
+	return r.Source.String() == other.Source.String()
+}
+
+func ruleMessage(rule RoutingRule) []byte {
+	header := make([]byte, fibRuleHdrLen)
+	header[0] = uint8(rule.Family)
+	if rule.Source != nil {
+		ones, _ := rule.Source.Mask.Size()
+		header[2] = uint8(ones)
+	}
+	if rule.Table < 256 {
+		header[4] = uint8(rule.Table)
+	}
+	header[7] = frActToTable
+
+	payload := header
+	if rule.Source != nil {
+		source := rule.Source.IP.To16()
+		if rule.Family == syscall.AF_INET {
+			source = rule.Source.IP.To4()
+		}
+		payload = append(payload, netlinkAttribute(fraSrc, source)...)
+	}
+	if rule.OutputInterface != "" {
+		payload = append(payload, netlinkAttribute(fraOifname, append([]byte(rule.OutputInterface), 0))...)
+	}
+	payload = append(payload, netlinkAttribute(fraPriority, nativeUint32Bytes(uint32(rule.Priority)))...)
+	payload = append(payload, netlinkAttribute(fraTable, nativeUint32Bytes(uint32(rule.Table)))...)
+
+	return payload
+}
+
+func listRules() ([]RoutingRule, error) {
+	messages, err := netlinkDump(syscall.RTM_GETRULE)
+	if err != nil {
+		return nil, err
+	}
+
+	rules := []RoutingRule{}
+	for _, message := range messages {
+		if message.Header.Type != syscall.RTM_NEWRULE || len(message.Data) < fibRuleHdrLen {
+			continue
+		}
+
+		rule := RoutingRule{
+			Family: int(message.Data[0]),
+			Table:  int(message.Data[4]),
+		}
+		sourceLength := int(message.Data[2])
+
+		// Rules share the route message layout closely enough for the attribute parser
+		// to work once it is told the header is a route header
+		message.Header.Type = syscall.RTM_NEWROUTE
+		attributes, err := syscall.ParseNetlinkRouteAttr(&message)
+		if err != nil {
+			continue
+		}
+
+		for _, attribute := range attributes {
+			switch attribute.Attr.Type {
+			case fraSrc:
+				ip := copyIP(attribute.Value)
+				rule.Source = &net.IPNet{IP: ip, Mask: net.CIDRMask(sourceLength, len(ip)*8)}
+			case fraPriority:
+				rule.Priority = int(nativeUint32(attribute.Value))
+			case fraTable:
+				rule.Table = int(nativeUint32(attribute.Value))
+			case fraOifname:
+				rule.OutputInterface = cString(attribute.Value)
+			}
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+func addRule(rule RoutingRule) error {
+	_, err := netlinkExecute(syscall.NETLINK_ROUTE, syscall.RTM_NEWRULE,
+		syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, ruleMessage(rule))
+	if errors.Is(err, syscall.EEXIST) {
+		return nil
+	}
+
+	return err
+}
+
+func deleteRule(rule RoutingRule) error {
+	_, err := netlinkExecute(syscall.NETLINK_ROUTE, syscall.RTM_DELRULE, 0, ruleMessage(rule))
+	if errors.Is(err, syscall.ENOENT) {
+		return nil
+	}
+
+	return err
+}
+
+// syncRules makes the rules pointing at a table exactly the wanted ones, so a rule for an
+// address the interface no longer has doesn't keep steering traffic into its table.
+func syncRules(table int, wanted []RoutingRule) error {
+	existing, err := listRules()
+	if err != nil {
+		return err
+	}
+
+	for _, rule := range existing {
+		if rule.Table != table {
+			continue
+		}
+
+		keep := false
+		for _, wantedRule := range wanted {
+			if rule.matches(wantedRule) {
+				keep = true
+				break
+			}
+		}
+
+		if !keep {
+			err = deleteRule(rule)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, rule := range wanted {
+		err = addRule(rule)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func policyRoutingTable(interfaceName string) int {
+	return Config.PolicyRoutingTableBase + Config.NetworkPriority[interfaceName]
+}
+
+// Interfaces left without policy routing because another one has their table, so that is
+// only logged once
+var sharedPolicyTables = map[string]bool{}
+
+// policyRoutingTables gives each uplink its table. The table follows from the priority, two
+// interfaces with the same one would fight over it, so the first by name keeps it and the
+// others are left out.
+func policyRoutingTables(uplinks []string) map[string]int {
+	tables := map[string]int{}
+	owners := map[int]string{}
+	for _, interfaceName := range uplinks {
+		table := policyRoutingTable(interfaceName)
+		if owner, ok := owners[table]; ok {
+			if !sharedPolicyTables[interfaceName] {
+				zap.S().Errorf("%s has the same NetworkPriority as %s, it gets no policy routing table until that changes",
+					interfaceName, owner)
+				sharedPolicyTables[interfaceName] = true
+			}
+			continue
+		}
+
+		delete(sharedPolicyTables, interfaceName)
+		owners[table] = interfaceName
+		tables[interfaceName] = table
+	}
+
+	return tables
+}
+
+// policyTableRoutes gives the copies of an interface's main table routes that belong in its
+// policy table, and the routes in that table that no longer have a main table route behind
+// them, e.g. the old default route after the gateway changed.
+func policyTableRoutes(routes []InterfaceRoute, table int) (wanted []InterfaceRoute, stale []InterfaceRoute) {
+	for _, route := range routes {
+		if route.Table != syscall.RT_TABLE_MAIN || route.Destination.IP.IsLinkLocalUnicast() {
+			continue
+		}
+
+		tableRoute := route
+		tableRoute.Table = table
+		tableRoute.Metric = 0
+		wanted = append(wanted, tableRoute)
+	}
+
+	for _, route := range routes {
+		if route.Table != table {
+			continue
+		}
+
+		found := false
+		for _, wantedRoute := range wanted {
+			if route.Destination.String() == wantedRoute.Destination.String() &&
+				route.Gateway.Equal(wantedRoute.Gateway) && route.Metric == wantedRoute.Metric {
+				found = true
+				break
+			}
+		}
+		if !found {
+			stale = append(stale, route)
+		}
+	}
+
+	return wanted, stale
+}
+
+// syncInterfacePolicyRouting copies the main table routes of an interface into its own table
+// and sends traffic sourced from its addresses, or bound to it, there. Probes on that interface
+// then work the same whether or not it currently holds the default route.
+func syncInterfacePolicyRouting(interfaceName string, table int) error {
+	state, err := getInterfaceState(interfaceName)
+	if err != nil {
+		return err
+	}
+
+	wantedRoutes, staleRoutes := policyTableRoutes(state.Routes, table)
+	for _, route := range staleRoutes {
+		err = deleteRoute(route, state.Index)
+		if err != nil {
+			return linkControlError("remove stale route from policy table for", interfaceName, err)
+		}
+	}
+
+	for _, route := range wantedRoutes {
+		err = replaceRoute(route, state.Index)
+		if err != nil {
+			return linkControlError("copy routes into policy table for", interfaceName, err)
+		}
+	}
+
+	wanted := []RoutingRule{}
+	for _, ipv6 := range []bool{false, true} {
+		family := syscall.AF_INET
+		if ipv6 {
+			family = syscall.AF_INET6
+		}
+
+		for _, address := range state.GlobalAddresses(ipv6) {
+			host := net.IPNet{IP: address.IP, Mask: net.CIDRMask(len(address.IP)*8, len(address.IP)*8)}
+			wanted = append(wanted, RoutingRule{
+				Family:   family,
+				Priority: Config.PolicyRoutingRulePriority,
+				Table:    table,
+				Source:   &host,
+			})
+		}
+
+		wanted = append(wanted, RoutingRule{
+			Family:          family,
+			Priority:        Config.PolicyRoutingRulePriority,
+			Table:           table,
+			OutputInterface: interfaceName,
+		})
+	}
+
+	err = syncRules(table, wanted)
+	if err != nil {
+		return linkControlError("set policy rules for", interfaceName, err)
+	}
+
+	return nil
+}
+
+func SyncPolicyRouting() {
+	if !Config.PolicyRouting {
+		return
+	}
+
+	tables := policyRoutingTables(uplinksByPriority())
+	for _, interfaceName := range uplinksByPriority() {
+		table, ok := tables[interfaceName]
+		if !ok {
+			continue
+		}
+
+		err := syncInterfacePolicyRouting(interfaceName, table)
+		if err != nil && !errors.Is(err, errInterfaceNotFound) {
+			zap.S().Errorf("unable to set up policy routing for %s, error: %v", interfaceName, err)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+	"testing"
+)
+
+func TestPolicyRoutingTables(t *testing.T) {
+	savedConfig, savedShared := Config, sharedPolicyTables
+	defer func() { Config, sharedPolicyTables = savedConfig, savedShared }()
+	sharedPolicyTables = map[string]bool{}
+	Config.PolicyRoutingTableBase = 100
+
+	tests := []struct {
+		name     string
+		priority map[string]int
+		uplinks  []string
+		want     map[string]int
+	}{
+		{"distinct priorities", map[string]int{"eth0": 1, "wwan0": 2}, []string{"eth0", "wwan0"},
+			map[string]int{"eth0": 101, "wwan0": 102}},
+		{"same priority", map[string]int{"eth0": 1, "eth1": 1, "wwan0": 2}, []string{"eth0", "eth1", "wwan0"},
+			map[string]int{"eth0": 101, "wwan0": 102}},
+		// Without a priority every interface lands on the base table
+		{"no priorities", map[string]int{}, []string{"eth0", "wwan0"}, map[string]int{"eth0": 100}},
+	}
+
+	for _, test := range tests {
+		Config.NetworkPriority = test.priority
+		if got := policyRoutingTables(test.uplinks); fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("%s: tables are %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestPolicyTableRoutes(t *testing.T) {
+	route := func(table int, destination string, gateway string, metric int) InterfaceRoute {
+		_, network, _ := net.ParseCIDR(destination)
+		return InterfaceRoute{Table: table, Destination: *network, Gateway: net.ParseIP(gateway), Metric: metric}
+	}
+
+	tests := []struct {
+		name       string
+		routes     []InterfaceRoute
+		wantRoutes int
+		wantStale  []string
+	}{
+		{"first sync", []InterfaceRoute{
+			route(syscall.RT_TABLE_MAIN, "0.0.0.0/0", "10.0.0.1", 100),
+			route(syscall.RT_TABLE_MAIN, "10.0.0.0/24", "", 100),
+			route(syscall.RT_TABLE_MAIN, "fe80::/64", "", 256),
+		}, 2, nil},
+		{"in sync", []InterfaceRoute{
+			route(syscall.RT_TABLE_MAIN, "0.0.0.0/0", "10.0.0.1", 100),
+			route(101, "0.0.0.0/0", "10.0.0.1", 0),
+		}, 1, nil},
+		{"gateway and subnet changed", []InterfaceRoute{
+			route(syscall.RT_TABLE_MAIN, "0.0.0.0/0", "10.0.1.1", 100),
+			route(syscall.RT_TABLE_MAIN, "10.0.1.0/24", "", 100),
+			route(101, "0.0.0.0/0", "10.0.0.1", 0),
+			route(101, "10.0.0.0/24", "", 0),
+			route(101, "10.0.1.0/24", "", 0),
+		}, 2, []string{"0.0.0.0/0 via 10.0.0.1", "10.0.0.0/24 via <nil>"}},
+		{"other tables untouched", []InterfaceRoute{
+			route(102, "0.0.0.0/0", "10.0.0.1", 0),
+		}, 0, nil},
+	}
+
+	for _, test := range tests {
+		wanted, stale := policyTableRoutes(test.routes, 101)
+		staleRoutes := []string{}
+		for _, route := range stale {
+			staleRoutes = append(staleRoutes, fmt.Sprintf("%s via %s", route.Destination.String(), route.Gateway))
+		}
+		if len(wanted) != test.wantRoutes || fmt.Sprint(staleRoutes) != fmt.Sprint(test.wantStale) {
+			t.Errorf("%s: %d routes and stale %v, want %d and %v",
+				test.name, len(wanted), staleRoutes, test.wantRoutes, test.wantStale)
+		}
+		for _, route := range wanted {
+			if route.Table != 101 || route.Metric != 0 {
+				t.Errorf("%s: copied route %+v not in table 101 with metric 0", test.name, route)
+			}
+		}
+	}
+}
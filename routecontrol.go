@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"syscall"
+	"unsafe"
+)
+
+// RTA_EXPIRES, missing from syscall
+const rtaExpires = 23
+
+func routeMessage(route InterfaceRoute, interfaceIndex int) []byte {
+	family := syscall.AF_INET6
+	destination := route.Destination.IP.To16()
+	gateway := route.Gateway.To16()
+	if route.Destination.IP.To4() != nil {
+		family = syscall.AF_INET
+		destination = route.Destination.IP.To4()
+		gateway = route.Gateway.To4()
+	}
+
+	prefixLength, _ := route.Destination.Mask.Size()
+
+	table := route.Table
+	if table == 0 {
+		table = syscall.RT_TABLE_MAIN
+	}
+
+	scope := syscall.RT_SCOPE_UNIVERSE
+	if route.Gateway == nil {
+		scope = syscall.RT_SCOPE_LINK
+	}
+
+	protocol := route.Protocol
+	if protocol == 0 {
+		protocol = syscall.RTPROT_BOOT
+	}
+
+	info := syscall.RtMsg{
+		Family:   uint8(family),
+		Dst_len:  uint8(prefixLength),
+		Protocol: uint8(protocol),
+		Scope:    uint8(scope),
+		Type:     syscall.RTN_UNICAST,
+	}
+
+	// The header only has room for the first 255 tables, RTA_TABLE covers the rest
+	if table < 256 {
+		info.Table = uint8(table)
+	} else {
+		info.Table = syscall.RT_TABLE_UNSPEC
+	}
+
+	payload := structBytes(unsafe.Pointer(&info), syscall.SizeofRtMsg)
+	if prefixLength > 0 {
+		payload = append(payload, netlinkAttribute(syscall.RTA_DST, destination)...)
+	}
+	if gateway != nil {
+		payload = append(payload, netlinkAttribute(syscall.RTA_GATEWAY, gateway)...)
+	}
+	if route.PreferredSource != nil {
+		source := route.PreferredSource.To16()
+		if family == syscall.AF_INET {
+			source = route.PreferredSource.To4()
+		}
+		payload = append(payload, netlinkAttribute(syscall.RTA_PREFSRC, source)...)
+	}
+	// Only IPv6 routes can be added with an expiry, in seconds
+	if route.Expires > 0 && family == syscall.AF_INET6 {
+		payload = append(payload, netlinkAttribute(rtaExpires, nativeUint32Bytes(uint32(route.Expires.Seconds())))...)
+	}
+	payload = append(payload, netlinkAttribute(syscall.RTA_OIF, nativeUint32Bytes(uint32(interfaceIndex)))...)
+	payload = append(payload, netlinkAttribute(syscall.RTA_PRIORITY, nativeUint32Bytes(uint32(route.Metric)))...)
+	payload = append(payload, netlinkAttribute(syscall.RTA_TABLE, nativeUint32Bytes(uint32(table)))...)
+
+	return payload
+}
+
+// replaceRoute adds the route or overwrites the one with the same destination, table and metric
+func replaceRoute(route InterfaceRoute, interfaceIndex int) error {
+	_, err := netlinkExecute(syscall.NETLINK_ROUTE, syscall.RTM_NEWROUTE,
+		syscall.NLM_F_CREATE|syscall.NLM_F_REPLACE, routeMessage(route, interfaceIndex))
+	return err
+}
+
+func deleteRoute(route InterfaceRoute, interfaceIndex int) error {
+	_, err := netlinkExecute(syscall.NETLINK_ROUTE, syscall.RTM_DELROUTE, 0, routeMessage(route, interfaceIndex))
+	if errors.Is(err, syscall.ESRCH) {
+		return nil
+	}
+
+	return err
+}
+
+// setDefaultRouteMetric moves the default routes of an interface in the main table to the
+// given metric. The metric is part of what identifies a route, so this is an add followed
+// by removing the old one rather than an in-place change. The copy keeps the protocol,
+// preferred source and expiry of the original, so the DHCP client or the RA handling still
+// recognise it as theirs when the lease renews.
+func setDefaultRouteMetric(interfaceName string, metric int) error {
+	state, err := getInterfaceState(interfaceName)
+	if err != nil {
+		return err
+	}
+
+	for _, route := range state.Routes {
+		if !route.IsDefault() || route.Table != syscall.RT_TABLE_MAIN || route.Metric == metric {
+			continue
+		}
+
+		updated := route
+		updated.Metric = metric
+		err = replaceRoute(updated, state.Index)
+		if err != nil {
+			return linkControlError("set route metric on", interfaceName, err)
+		}
+
+		err = deleteRoute(route, state.Index)
+		if err != nil {
+			return linkControlError("remove old default route on", interfaceName, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+const (
+	ipForwardPath  = "/proc/sys/net/ipv4/ip_forward"
+	routerNftTable = "cm_router"
+)
+
+// RouterMode shares the active uplink with the LAN interface. The NAT rules name the uplink
+// explicitly, so they are rewritten whenever the WAN manager moves traffic to another one.
+type RouterMode struct {
+	appliedUplink string
+	appliedConfig *RouterConfig
+	dhcpServer    *DHCPServer
+}
+
+var routerMode RouterMode
+
+func enableIPForwarding() error {
+	err := os.WriteFile(ipForwardPath, []byte("1\n"), 0644)
+	if err != nil {
+		return fmt.Errorf("unable to enable ip forwarding, error: %v", err)
+	}
+
+	return nil
+}
+
+func routerRuleset(lanInterface string, lanNetwork *net.IPNet, uplink string) string {
+	lines := []string{
+		nftReplaceTable("ip", routerNftTable),
+		fmt.Sprintf("table ip %s {", routerNftTable),
+		"	chain postrouting {",
+		"		type nat hook postrouting priority srcnat; policy accept;",
+		fmt.Sprintf("		ip saddr %s oifname \"%s\" masquerade", lanNetwork, uplink),
+		"	}",
+		"	chain forward {",
+		"		type filter hook forward priority filter; policy accept;",
+		fmt.Sprintf("		iifname \"%s\" oifname \"%s\" accept", lanInterface, uplink),
+		fmt.Sprintf("		iifname \"%s\" oifname \"%s\" ct state established,related accept", uplink, lanInterface),
+		fmt.Sprintf("		iifname \"%s\" oifname \"%s\" drop", uplink, lanInterface),
+		"	}",
+		"}",
+	}
+
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func (r *RouterMode) startDHCPServer() {
+	if r.dhcpServer != nil {
+		r.dhcpServer.Stop()
+		r.dhcpServer = nil
+	}
+
+	if !Config.Router.DHCPServer {
+		return
+	}
+
+	server, err := newDHCPServer(Config.Router)
+	if err != nil {
+		zap.S().Errorf("unable to configure dhcp server, error: %v", err)
+		return
+	}
+
+	err = server.Start()
+	if err != nil {
+		zap.S().Errorf("unable to start dhcp server, error: %v", err)
+		return
+	}
+	r.dhcpServer = server
+}
+
+func (r *RouterMode) disable() {
+	if r.appliedConfig == nil {
+		return
+	}
+
+	if r.dhcpServer != nil {
+		r.dhcpServer.Stop()
+		r.dhcpServer = nil
+	}
+
+	err := removeNftTable("ip", routerNftTable)
+	if err != nil {
+		zap.S().Errorf("unable to remove router rules, error: %v", err)
+		return
+	}
+
+	zap.S().Infof("router mode disabled")
+	r.appliedConfig = nil
+	r.appliedUplink = ""
+}
+
+// Manage brings the LAN side in line with the configuration and points NAT at the given
+// uplink. Nothing is touched while neither has changed.
+func (r *RouterMode) Manage(uplink string) {
+	if !Config.Router.Enabled {
+		r.disable()
+		return
+	}
+
+	configChanged := r.appliedConfig == nil || !reflect.DeepEqual(*r.appliedConfig, Config.Router)
+	if !configChanged && uplink == r.appliedUplink {
+		return
+	}
+
+	lanIP, lanNetwork, err := net.ParseCIDR(Config.Router.LanAddress)
+	if err != nil || lanIP.To4() == nil {
+		zap.S().Errorf("router lan address %q must be an ipv4 cidr", Config.Router.LanAddress)
+		return
+	}
+
+	if configChanged {
+		err = enableIPForwarding()
+		if err != nil {
+			zap.S().Error(err)
+			return
+		}
+
+		err = setLinkUp(Config.Router.LanInterface)
+		if err == nil {
+			err = addAddress(Config.Router.LanInterface, net.IPNet{IP: lanIP, Mask: lanNetwork.Mask})
+		}
+		if err != nil {
+			zap.S().Errorf("unable to set up lan interface %s, error: %v", Config.Router.LanInterface, err)
+			return
+		}
+
+		r.startDHCPServer()
+	}
+
+	if uplink == "" {
+		zap.S().Warnf("no active uplink to share with %s yet", Config.Router.LanInterface)
+		return
+	}
+
+	err = applyNftRuleset(routerRuleset(Config.Router.LanInterface, lanNetwork, uplink))
+	if err != nil {
+		zap.S().Error(err)
+		return
+	}
+
+	if r.appliedUplink != uplink {
+		zap.S().Infof("sharing %s with %s", uplink, Config.Router.LanInterface)
+	}
+	applied := Config.Router
+	r.appliedConfig = &applied
+	r.appliedUplink = uplink
+}
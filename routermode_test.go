@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestRouterRuleset(t *testing.T) {
+	_, lanNetwork, _ := net.ParseCIDR("192.168.8.0/24")
+
+	want := `table ip cm_router {}
+delete table ip cm_router
+table ip cm_router {
+	chain postrouting {
+		type nat hook postrouting priority srcnat; policy accept;
+		ip saddr 192.168.8.0/24 oifname "wwan0" masquerade
+	}
+	chain forward {
+		type filter hook forward priority filter; policy accept;
+		iifname "eth0" oifname "wwan0" accept
+		iifname "wwan0" oifname "eth0" ct state established,related accept
+		iifname "wwan0" oifname "eth0" drop
+	}
+}
+`
+
+	if got := routerRuleset("eth0", lanNetwork, "wwan0"); got != want {
+		t.Errorf("router ruleset is\n%s\nwant\n%s", got, want)
+	}
+}
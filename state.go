@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v2"
+)
+
+// State holds what the daemon learns at runtime and wants to keep across restarts,
+// as opposed to Configuration which is what the user asked for.
+type State struct {
+	// Last APN that carried traffic, keyed by SIM ICCID
+	LastWorkingAPN map[string]string
+	// Byte counts keyed by interface name
+	DataUsage map[string]*InterfaceUsage
+	// Operator the modem was locked to by NetworkLock, so only that lock is undone when it
+	// is removed and not a selection made by hand
+	OperatorLock string
+}
+
+var state State
+
+func loadState() (State, error) {
+	var savedState State
+	if _, err := os.Stat("state.yaml"); err == nil {
+		data, err := os.ReadFile("state.yaml")
+		if err != nil {
+			return State{}, err
+		}
+		err = yaml.Unmarshal(data, &savedState)
+		if err != nil {
+			return State{}, err
+		}
+	}
+
+	if savedState.LastWorkingAPN == nil {
+		savedState.LastWorkingAPN = map[string]string{}
+	}
+
+	if savedState.DataUsage == nil {
+		savedState.DataUsage = map[string]*InterfaceUsage{}
+	}
+
+	return savedState, nil
+}
+
+func saveState(savedState *State) error {
+	data, err := yaml.Marshal(savedState)
+	if err != nil {
+		return fmt.Errorf("error parsing state, err: %v", err)
+	}
+
+	err = os.WriteFile("state.yaml", data, 0644)
+	if err != nil {
+		return fmt.Errorf("error writing state, err: %v", err)
+	}
+
+	return nil
+}
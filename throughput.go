@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const throughputHistoryLength = 20
+
+type ThroughputResult struct {
+	Interface     string
+	Timestamp     time.Time
+	DownloadBytes int64
+	DownloadMbps  float64
+	UploadBytes   int64
+	UploadMbps    float64
+	Error         string
+}
+
+func megabitsPerSecond(transferred int64, elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		return 0
+	}
+
+	return float64(transferred*8) / elapsed.Seconds() / 1000000
+}
+
+func throughputClient(interfaceName string, timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext:       boundDialer(interfaceName, timeout).DialContext,
+			DisableKeepAlives: true,
+			// Compressed test data would make the link look faster than it is
+			DisableCompression: true,
+		},
+	}
+}
+
+// measureDownload reads at most maxBytes of the response. The range header saves the server
+// from sending the rest, and if it ignores it we stop reading and drop the connection anyway.
+func measureDownload(client *http.Client, target string, maxBytes int64) (int64, time.Duration, error) {
+	request, err := http.NewRequest(http.MethodGet, target, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	request.Header.Set("Range", fmt.Sprintf("bytes=0-%d", maxBytes-1))
+
+	start := time.Now()
+	response, err := client.Do(request)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK && response.StatusCode != http.StatusPartialContent {
+		return 0, 0, fmt.Errorf("download endpoint answered %s", response.Status)
+	}
+
+	transferred, err := io.Copy(io.Discard, io.LimitReader(response.Body, maxBytes))
+	return transferred, time.Since(start), err
+}
+
+func measureUpload(client *http.Client, target string, maxBytes int64) (int64, time.Duration, error) {
+	start := time.Now()
+	response, err := client.Post(target, "application/octet-stream", bytes.NewReader(make([]byte, maxBytes)))
+	if err != nil {
+		return 0, 0, err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(response.Body, 4096))
+
+	if response.StatusCode >= 300 {
+		return 0, 0, fmt.Errorf("upload endpoint answered %s", response.Status)
+	}
+
+	return maxBytes, time.Since(start), nil
+}
+
+// runThroughputTest measures both directions out of one interface. Either endpoint may be left
+// out of the configuration to test one direction only.
+func runThroughputTest(interfaceName string, config ThroughputTestConfig) ThroughputResult {
+	result := ThroughputResult{Interface: interfaceName, Timestamp: time.Now()}
+	client := throughputClient(interfaceName, time.Duration(config.Timeout)*time.Second)
+
+	if config.DownloadURL != "" {
+		transferred, elapsed, err := measureDownload(client, config.DownloadURL, config.MaxBytes)
+		if err != nil {
+			result.Error = fmt.Sprintf("download: %v", err)
+			return result
+		}
+		result.DownloadBytes = transferred
+		result.DownloadMbps = megabitsPerSecond(transferred, elapsed)
+	}
+
+	if config.UploadURL != "" {
+		transferred, elapsed, err := measureUpload(client, config.UploadURL, config.MaxBytes)
+		if err != nil {
+			result.Error = fmt.Sprintf("upload: %v", err)
+			return result
+		}
+		result.UploadBytes = transferred
+		result.UploadMbps = megabitsPerSecond(transferred, elapsed)
+	}
+
+	return result
+}
+
+// ThroughputTester runs the test on schedule or when asked to, one run at a time since the
+// runs would compete for the same links.
+type ThroughputTester struct {
+	mutex     sync.Mutex
+	running   bool
+	requested bool
+	lastRun   time.Time
+	history   []ThroughputResult
+	watching  sync.Once
+}
+
+var throughputTester ThroughputTester
+
+// Request asks for a test on the next Manage, whatever the schedule says
+func (t *ThroughputTester) Request() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.requested = true
+}
+
+func (t *ThroughputTester) watchSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	for range signals {
+		zap.S().Info("throughput test requested")
+		t.Request()
+	}
+}
+
+func (t *ThroughputTester) History() []ThroughputResult {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return append([]ThroughputResult{}, t.history...)
+}
+
+// scheduledTestBlocked gives the reason a scheduled test must not spend data on an interface,
+// empty when it may. Tests asked for with SIGUSR1 run anyway.
+func scheduledTestBlocked(interfaceName string, status DataUsageStatus) string {
+	if status.Capped {
+		return "its data cap is reached"
+	}
+	if isMeteredInterface(interfaceName) {
+		return "it is metered"
+	}
+
+	return ""
+}
+
+// Manage starts a test when one is due, on the modem interface unless Interfaces names others.
+// Scheduled tests leave out the interfaces where data costs.
+func (t *ThroughputTester) Manage(modemInterface string, usage map[string]DataUsageStatus) {
+	t.watching.Do(func() {
+		go t.watchSignal()
+	})
+
+	config := Config.ThroughputTest
+	if config.DownloadURL == "" && config.UploadURL == "" {
+		return
+	}
+	if config.MaxBytes <= 0 {
+		config.MaxBytes = 1000000
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 30
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	due := config.Interval > 0 && time.Since(t.lastRun) >= time.Duration(config.Interval)*time.Minute
+	if t.running || !(due || t.requested) {
+		return
+	}
+
+	configured := config.Interfaces
+	if len(configured) == 0 {
+		configured = []string{modemInterface}
+	}
+
+	interfaceNames := []string{}
+	for _, interfaceName := range configured {
+		if reason := scheduledTestBlocked(interfaceName, usage[interfaceName]); !t.requested && reason != "" {
+			zap.S().Infof("skipping scheduled throughput test on %s, %s", interfaceName, reason)
+			continue
+		}
+		interfaceNames = append(interfaceNames, interfaceName)
+	}
+
+	t.requested = false
+	t.lastRun = time.Now()
+	if len(interfaceNames) == 0 {
+		return
+	}
+
+	t.running = true
+	go t.run(interfaceNames, config)
+}
+
+func (t *ThroughputTester) run(interfaceNames []string, config ThroughputTestConfig) {
+	for _, interfaceName := range interfaceNames {
+		result := runThroughputTest(interfaceName, config)
+		if result.Error != "" {
+			zap.S().Warnf("throughput test on %s failed, error: %s", interfaceName, result.Error)
+		} else {
+			zap.S().Infof("throughput on %s: %.2f Mbps down, %.2f Mbps up",
+				interfaceName, result.DownloadMbps, result.UploadMbps)
+		}
+
+		t.mutex.Lock()
+		t.history = append(t.history, result)
+		if len(t.history) > throughputHistoryLength {
+			t.history = t.history[len(t.history)-throughputHistoryLength:]
+		}
+		t.mutex.Unlock()
+	}
+
+	t.mutex.Lock()
+	t.running = false
+	t.mutex.Unlock()
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+// The test client binds to lo like it would to an uplink, which takes CAP_NET_RAW
+func skipUnlessRoot(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("binding to an interface needs root")
+	}
+}
+
+func TestRunThroughputTest(t *testing.T) {
+	skipUnlessRoot(t)
+	const maxBytes = 256 * 1024
+
+	tests := []struct {
+		name         string
+		served       int
+		honourRange  bool
+		wantDownload int64
+	}{
+		// The server ignores the range, reading stops at MaxBytes anyway
+		{"ignores range", 4 * maxBytes, false, maxBytes},
+		{"honours range", 4 * maxBytes, true, maxBytes},
+		{"smaller than max", maxBytes / 2, false, maxBytes / 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			uploaded := make(chan int64, 1)
+			mux := http.NewServeMux()
+			mux.HandleFunc("/download", func(w http.ResponseWriter, r *http.Request) {
+				body := bytes.Repeat([]byte{0xa5}, test.served)
+				if test.honourRange && r.Header.Get("Range") != "" {
+					http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(body))
+					return
+				}
+				w.Write(body)
+			})
+			mux.HandleFunc("/upload", func(w http.ResponseWriter, r *http.Request) {
+				received, _ := io.Copy(io.Discard, r.Body)
+				uploaded <- received
+			})
+			server := httptest.NewServer(mux)
+			defer server.Close()
+
+			config := ThroughputTestConfig{
+				DownloadURL: server.URL + "/download",
+				UploadURL:   server.URL + "/upload",
+				MaxBytes:    maxBytes,
+				Timeout:     10,
+			}
+			result := runThroughputTest("lo", config)
+			if result.Error != "" {
+				t.Fatalf("throughput test failed, error: %s", result.Error)
+			}
+
+			if result.DownloadBytes != test.wantDownload {
+				t.Errorf("downloaded %d bytes, want %d", result.DownloadBytes, test.wantDownload)
+			}
+			if result.UploadBytes != maxBytes {
+				t.Errorf("upload reported %d bytes, want %d", result.UploadBytes, maxBytes)
+			}
+			if received := <-uploaded; received != maxBytes {
+				t.Errorf("server received %d bytes, want %d", received, maxBytes)
+			}
+			if result.DownloadMbps <= 0 || result.UploadMbps <= 0 {
+				t.Errorf("rates %.2f/%.2f Mbps, want them above 0", result.DownloadMbps, result.UploadMbps)
+			}
+		})
+	}
+}
+
+func TestRunThroughputTestEndpointError(t *testing.T) {
+	skipUnlessRoot(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "gone", http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	result := runThroughputTest("lo", ThroughputTestConfig{DownloadURL: server.URL, MaxBytes: 1024, Timeout: 10})
+	if result.Error == "" || result.DownloadBytes != 0 {
+		t.Errorf("got %+v, want a download error", result)
+	}
+}
+
+func TestScheduledTestBlocked(t *testing.T) {
+	saved := Config
+	defer func() { Config = saved }()
+
+	tests := []struct {
+		interfaceName string
+		metered       bool
+		status        DataUsageStatus
+		blocked       bool
+	}{
+		{"wwan0", false, DataUsageStatus{}, false},
+		{"wwan0", true, DataUsageStatus{}, true},
+		{"eth0", true, DataUsageStatus{}, false},
+		{"eth0", false, DataUsageStatus{Warning: true}, false},
+		{"eth0", false, DataUsageStatus{Capped: true, Action: "failover"}, true},
+		{"eth0", false, DataUsageStatus{Capped: true, Action: "block"}, true},
+	}
+
+	for _, test := range tests {
+		Config = Configuration{MeteredPolicy: test.metered, CellularInterfaces: []string{"wwan0"}}
+		if reason := scheduledTestBlocked(test.interfaceName, test.status); (reason != "") != test.blocked {
+			t.Errorf("scheduled test on %s with metered %t and %+v blocked by %q, want blocked %t",
+				test.interfaceName, test.metered, test.status, reason, test.blocked)
+		}
+	}
+}
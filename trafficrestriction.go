@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// daemonDestinations are the hosts the daemon itself talks to: the WireGuard endpoint so a
+// restricted link can still be reached, the connectivity check and keepalive targets so the
+// restriction doesn't make the link look dead. The throughput test endpoints aren't among them,
+// a restricted link is one that shouldn't spend data on tests.
+func daemonDestinations() []string {
+	hosts := []string{}
+	addHostPort := func(hostPort string) {
+		host, _, err := net.SplitHostPort(hostPort)
+		if err == nil {
+			hosts = append(hosts, host)
+		}
+	}
+
+	if Config.WireGuard.Enabled && Config.WireGuard.PeerEndpoint != "" {
+		addHostPort(Config.WireGuard.PeerEndpoint)
+	}
+
+	for _, check := range Config.ConnectivityChecks {
+		switch check.Type {
+		case "tcp":
+			addHostPort(check.Target)
+		case "http":
+			target, err := url.Parse(check.Target)
+			if err == nil && target.Hostname() != "" {
+				hosts = append(hosts, target.Hostname())
+			}
+		}
+	}
+
+	for _, keepalive := range Config.Keepalives {
+		keepalive = keepalive.withDefaults()
+		if keepalive.Mode == "udp" {
+			addHostPort(keepalive.Target)
+		}
+		if keepalive.Adaptive {
+			addHostPort(keepalive.StunServer)
+		}
+	}
+
+	return hosts
+}
+
+// resolveDestinations turns AllowedDestinations into addresses nft can match on. Entries are
+// addresses, CIDRs or host names, names are resolved every time the rules are written.
+func resolveDestinations(destinations []string) (ipv4 []string, ipv6 []string) {
+	destinations = append(append([]string{}, destinations...), daemonDestinations()...)
+
+	seen := map[string]bool{}
+	add := func(network string, isIPv6 bool) {
+		if seen[network] {
+			return
+		}
+		seen[network] = true
+		if isIPv6 {
+			ipv6 = append(ipv6, network)
+		} else {
+			ipv4 = append(ipv4, network)
+		}
+	}
+
+	for _, destination := range destinations {
+		if _, network, err := net.ParseCIDR(destination); err == nil {
+			add(network.String(), network.IP.To4() == nil)
+			continue
+		}
+
+		if ip := net.ParseIP(destination); ip != nil {
+			add(ip.String(), ip.To4() == nil)
+			continue
+		}
+
+		addresses, err := net.LookupIP(destination)
+		if err != nil {
+			zap.S().Warnf("unable to resolve allowed destination %s, error: %v", destination, err)
+			continue
+		}
+		for _, ip := range addresses {
+			add(ip.String(), ip.To4() == nil)
+		}
+	}
+
+	sort.Strings(ipv4)
+	sort.Strings(ipv6)
+	return ipv4, ipv6
+}
+
+// restrictionRuleset lets only DNS, NTP, ICMP and the allowed destinations out of the given
+// interfaces, both from the device itself and from anything routed through it.
+func restrictionRuleset(table string, interfaceNames []string, destinations []string) string {
+	ipv4, ipv6 := resolveDestinations(destinations)
+
+	lines := []string{
+		nftReplaceTable("inet", table),
+		fmt.Sprintf("table inet %s {", table),
+	}
+
+	if len(ipv4) > 0 {
+		lines = append(lines, fmt.Sprintf("	set allowed4 { type ipv4_addr; flags interval; elements = { %s } }",
+			strings.Join(ipv4, ", ")))
+	}
+	if len(ipv6) > 0 {
+		lines = append(lines, fmt.Sprintf("	set allowed6 { type ipv6_addr; flags interval; elements = { %s } }",
+			strings.Join(ipv6, ", ")))
+	}
+
+	for _, chain := range []string{"output", "forward"} {
+		lines = append(lines,
+			fmt.Sprintf("	chain %s {", chain),
+			fmt.Sprintf("		type filter hook %s priority filter; policy accept;", chain))
+
+		for _, interfaceName := range interfaceNames {
+			match := fmt.Sprintf("		oifname \"%s\"", interfaceName)
+			lines = append(lines,
+				match+" udp dport { 53, 123 } accept",
+				match+" tcp dport 53 accept",
+				match+" meta l4proto { icmp, ipv6-icmp } accept")
+			if len(ipv4) > 0 {
+				lines = append(lines, match+" ip daddr @allowed4 accept")
+			}
+			if len(ipv6) > 0 {
+				lines = append(lines, match+" ip6 daddr @allowed6 accept")
+			}
+			lines = append(lines, match+" drop")
+		}
+
+		lines = append(lines, "	}")
+	}
+
+	lines = append(lines, "}")
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// TrafficRestriction keeps one nft table restricting a set of interfaces. The rules are only
+// rewritten when they change, which also catches allowed names resolving to new addresses.
+// The first call always writes them, a table left from before a restart may be stale.
+type TrafficRestriction struct {
+	table       string
+	applied     string
+	initialized bool
+}
+
+func (t *TrafficRestriction) Apply(interfaceNames []string) error {
+	sort.Strings(interfaceNames)
+
+	ruleset := ""
+	if len(interfaceNames) > 0 {
+		ruleset = restrictionRuleset(t.table, interfaceNames, Config.AllowedDestinations)
+	}
+	if t.initialized && ruleset == t.applied {
+		return nil
+	}
+
+	var err error
+	if ruleset == "" {
+		err = removeNftTable("inet", t.table)
+	} else {
+		err = applyNftRuleset(ruleset)
+	}
+	if err != nil {
+		return err
+	}
+
+	if ruleset == "" && t.applied != "" {
+		zap.S().Infof("lifted traffic restriction %s", t.table)
+	} else if ruleset != "" && t.applied == "" {
+		zap.S().Infof("restricting traffic on %s to allowed destinations", strings.Join(interfaceNames, ", "))
+	}
+	t.applied = ruleset
+	t.initialized = true
+	return nil
+}
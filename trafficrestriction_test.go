@@ -0,0 +1,53 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRestrictionRuleset(t *testing.T) {
+	saved := Config
+	defer func() { Config = saved }()
+	Config = Configuration{
+		WireGuard:          WireGuardConfig{Enabled: true, PeerEndpoint: "198.51.100.7:51820"},
+		ConnectivityChecks: []ConnectivityCheck{{Type: "tcp", Target: "192.0.2.10:443"}},
+	}
+
+	got := restrictionRuleset("cm_metered", []string{"wwan0"}, []string{"10.20.0.0/16", "2001:db8::1", "10.20.1.1"})
+
+	for _, line := range []string{
+		"table inet cm_metered {}\ndelete table inet cm_metered\ntable inet cm_metered {",
+		"set allowed4 { type ipv4_addr; flags interval; elements = { 10.20.0.0/16, 10.20.1.1, 192.0.2.10, 198.51.100.7 } }",
+		"set allowed6 { type ipv6_addr; flags interval; elements = { 2001:db8::1 } }",
+		"chain output {",
+		"chain forward {",
+		"oifname \"wwan0\" udp dport { 53, 123 } accept",
+		"oifname \"wwan0\" ip daddr @allowed4 accept",
+		"oifname \"wwan0\" ip6 daddr @allowed6 accept",
+	} {
+		if !strings.Contains(got, line) {
+			t.Errorf("ruleset is missing %q:\n%s", line, got)
+		}
+	}
+
+	// The drop has to come after everything that is let through, in both chains
+	for _, chain := range strings.Split(got, "chain ")[1:] {
+		if !strings.HasSuffix(strings.TrimSpace(strings.SplitN(chain, "\n\t}", 2)[0]), "oifname \"wwan0\" drop") {
+			t.Errorf("chain doesn't end in a drop:\n%s", chain)
+		}
+	}
+}
+
+func TestRestrictionRulesetWithoutDestinations(t *testing.T) {
+	saved := Config
+	defer func() { Config = saved }()
+	Config = Configuration{}
+
+	got := restrictionRuleset("cm_datacap", []string{"wwan0", "wwan1"}, nil)
+	if strings.Contains(got, "set allowed") || strings.Contains(got, "@allowed") {
+		t.Errorf("empty sets in ruleset:\n%s", got)
+	}
+	if strings.Count(got, "drop") != 4 {
+		t.Errorf("want a drop per interface and chain:\n%s", got)
+	}
+}
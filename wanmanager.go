@@ -0,0 +1,227 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type UplinkStatus struct {
+	Priority  int
+	Healthy   bool
+	Latency   int
+	Failures  int
+	Successes int
+	Metric    int
+	checked   bool
+}
+
+// WanManager looks after every interface in NetworkPriority, not only the cellular one, and
+// keeps the default route on the best healthy one. An uplink has to fail or recover a few
+// checks in a row before it changes state so a single lost ping doesn't move traffic around.
+type WanManager struct {
+	Uplinks      map[string]*UplinkStatus
+	ActiveUplink string
+}
+
+var wanManager = WanManager{Uplinks: map[string]*UplinkStatus{}}
+
+func isCellularInterface(interfaceName string) bool {
+	for _, cellularInterface := range Config.CellularInterfaces {
+		if cellularInterface == interfaceName {
+			return true
+		}
+	}
+
+	return false
+}
+
+// uplinksByPriority lists the interfaces from NetworkPriority, lowest number first. In router
+// mode the LAN interface serves clients and is never an uplink.
+func uplinksByPriority() []string {
+	uplinks := make([]string, 0, len(Config.NetworkPriority))
+	for interfaceName := range Config.NetworkPriority {
+		if Config.Router.Enabled && interfaceName == Config.Router.LanInterface {
+			continue
+		}
+		uplinks = append(uplinks, interfaceName)
+	}
+
+	sort.Slice(uplinks, func(i, j int) bool {
+		if Config.NetworkPriority[uplinks[i]] == Config.NetworkPriority[uplinks[j]] {
+			return uplinks[i] < uplinks[j]
+		}
+		return Config.NetworkPriority[uplinks[i]] < Config.NetworkPriority[uplinks[j]]
+	})
+
+	return uplinks
+}
+
+func uplinkPingTimeout(interfaceName string) int {
+	if isCellularInterface(interfaceName) {
+		return Config.PingTimeout
+	}
+
+	return Config.OtherPingTimeout
+}
+
+func (w *WanManager) recordCheck(interfaceName string, latency int, err error) {
+	uplink, ok := w.Uplinks[interfaceName]
+	if !ok {
+		uplink = &UplinkStatus{}
+		w.Uplinks[interfaceName] = uplink
+	}
+	uplink.Priority = Config.NetworkPriority[interfaceName]
+
+	if err == nil {
+		uplink.Latency = latency
+		uplink.Successes++
+		uplink.Failures = 0
+	} else {
+		uplink.Latency = 0
+		uplink.Failures++
+		uplink.Successes = 0
+	}
+
+	// The first result counts straight away, there is nothing to flap from yet
+	if !uplink.checked {
+		uplink.checked = true
+		uplink.Healthy = err == nil
+		return
+	}
+
+	if !uplink.Healthy && uplink.Successes >= Config.WanRecoverThreshold {
+		zap.S().Infof("uplink %s recovered", interfaceName)
+		uplink.Healthy = true
+	}
+
+	if uplink.Healthy && uplink.Failures >= Config.WanFailThreshold {
+		zap.S().Infof("uplink %s failed %d checks in a row", interfaceName, uplink.Failures)
+		uplink.Healthy = false
+		remediateUplink(interfaceName)
+	}
+}
+
+// remediateUplink tries the cheap fix for an uplink that just went unhealthy. The cellular
+// interface is left alone, the conductor already has its own escalation for it.
+func remediateUplink(interfaceName string) {
+	if interfaceName == Config.WifiInterface && len(Config.WifiNetworks) > 0 {
+		err := wifiManager.Reassociate()
+		if err != nil {
+			zap.S().Errorf("unable to reassociate %s, error: %v", interfaceName, err)
+		}
+	}
+}
+
+// rankUplinks puts healthy uplinks first, each group in NetworkPriority order
+func (w *WanManager) rankUplinks() []string {
+	healthy := []string{}
+	unhealthy := []string{}
+
+	for _, interfaceName := range uplinksByPriority() {
+		if uplink, ok := w.Uplinks[interfaceName]; ok && uplink.Healthy {
+			healthy = append(healthy, interfaceName)
+		} else {
+			unhealthy = append(unhealthy, interfaceName)
+		}
+	}
+
+	return append(healthy, unhealthy...)
+}
+
+func (w *WanManager) CheckUplinks() {
+	SyncPolicyRouting()
+
+	for _, interfaceName := range uplinksByPriority() {
+		health, _, err := checkUplinkConnectivity(interfaceName, uplinkPingTimeout(interfaceName))
+		if err == nil && interfaceName == Config.EthernetInterface && ethernetMonitor.Status().Degraded {
+			err = fmt.Errorf("gateway doesn't answer arp")
+		}
+		if err == nil {
+			err = wireGuard.HealthError(interfaceName)
+		}
+		if err == nil && dataUsage.FailoverRequired(interfaceName) {
+			err = fmt.Errorf("data cap reached")
+		}
+		if err != nil {
+			zap.S().Debugf("uplink %s check failed, error: %v", interfaceName, err)
+		}
+		w.recordCheck(interfaceName, health.Latency(), err)
+	}
+
+	ranked := w.rankUplinks()
+	if len(ranked) > 0 && w.Uplinks[ranked[0]].Healthy && ranked[0] != w.ActiveUplink {
+		zap.S().Infof("switching active uplink from %q to %s", w.ActiveUplink, ranked[0])
+		w.ActiveUplink = ranked[0]
+	}
+
+	for rank, interfaceName := range ranked {
+		metric := (rank + 1) * Config.WanMetricStep
+		w.Uplinks[interfaceName].Metric = metric
+
+		err := setDefaultRouteMetric(interfaceName, metric)
+		if err != nil && !errors.Is(err, errInterfaceNotFound) {
+			zap.S().Errorf("unable to set route metric for %s, error: %v", interfaceName, err)
+		}
+	}
+}
+
+// currentUplink falls back to the modem interface until an uplink was picked
+func (w *WanManager) currentUplink(modemInterface string) string {
+	if w.ActiveUplink != "" {
+		return w.ActiveUplink
+	}
+
+	return modemInterface
+}
+
+func (w *WanManager) UpdateMonitoring(monitoring *MonitoringProperties) {
+	monitoring.ActiveUplink = w.ActiveUplink
+	monitoring.Uplinks = map[string]UplinkStatus{}
+	for interfaceName, uplink := range w.Uplinks {
+		monitoring.Uplinks[interfaceName] = *uplink
+	}
+}
+
+// manageUplinks runs next to manageConnections. Probing is done outside the lock since a round
+// of pings across every uplink can take a while. The modem interface is set by the connection
+// manager, so it is read under the lock and handed to what runs outside it.
+func manageUplinks() {
+	for {
+		lock.Lock()
+		dataUsage.Update()
+		ApplyInterfaceMTUs()
+		modemInterface := networkModem.InterfaceName
+		lock.Unlock()
+
+		wifiManager.Manage()
+		if !Config.Router.Enabled || Config.Router.LanInterface != Config.EthernetInterface {
+			ethernetMonitor.Update()
+		}
+		wanManager.CheckUplinks()
+		uplink := wanManager.currentUplink(modemInterface)
+		routerMode.Manage(uplink)
+		wireGuard.Manage(wanManager.ActiveUplink)
+		natKeepalive.Manage()
+		dataUsage.Enforce()
+		ManageMeteredPolicy(uplink)
+		throughputTester.Manage(modemInterface, dataUsage.Statuses())
+		packetCapture.Manage(modemInterface)
+
+		lock.Lock()
+		wanManager.UpdateMonitoring(&networkModem.MonitoringProperties)
+		networkModem.MonitoringProperties.Wifi = wifiManager.Status
+		networkModem.MonitoringProperties.Ethernet = ethernetMonitor.Status()
+		networkModem.MonitoringProperties.WireGuard = wireGuard.Status()
+		networkModem.MonitoringProperties.Keepalives = natKeepalive.Statuses()
+		networkModem.MonitoringProperties.DataUsage = dataUsage.Statuses()
+		networkModem.MonitoringProperties.ThroughputHistory = throughputTester.History()
+		networkModem.MonitoringProperties.LastCapture = packetCapture.Last()
+		lock.Unlock()
+
+		time.Sleep(time.Duration(Config.WanCheckInterval) * time.Second)
+	}
+}
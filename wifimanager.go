@@ -0,0 +1,396 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type WifiScanResult struct {
+	BSSID     string
+	Frequency int
+	Signal    int
+	Flags     string
+	SSID      string
+}
+
+type WifiStatus struct {
+	State       string
+	SSID        string
+	BSSID       string
+	Frequency   int
+	RSSI        int
+	ScanResults []WifiScanResult
+}
+
+// WpaClient talks to wpa_supplicant over its control socket. Every client needs its own bound
+// socket for the replies, wpa_supplicant answers to whatever address the request came from.
+type WpaClient struct {
+	conn      *net.UnixConn
+	localPath string
+}
+
+var wpaClientCounter uint32
+
+func dialWpaSupplicant(controlDir string, interfaceName string) (*WpaClient, error) {
+	remote := &net.UnixAddr{Name: filepath.Join(controlDir, interfaceName), Net: "unixgram"}
+	localPath := filepath.Join(os.TempDir(),
+		fmt.Sprintf("wpa_ctrl_%d-%d", os.Getpid(), atomic.AddUint32(&wpaClientCounter, 1)))
+	local := &net.UnixAddr{Name: localPath, Net: "unixgram"}
+
+	conn, err := net.DialUnix("unixgram", local, remote)
+	if err != nil {
+		os.Remove(localPath)
+		return nil, fmt.Errorf("unable to reach wpa_supplicant at %s, error: %v", remote.Name, err)
+	}
+
+	return &WpaClient{conn: conn, localPath: localPath}, nil
+}
+
+func (c *WpaClient) Close() {
+	c.conn.Close()
+	os.Remove(c.localPath)
+}
+
+func (c *WpaClient) Request(command string) (string, error) {
+	err := c.conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if err != nil {
+		return "", err
+	}
+
+	_, err = c.conn.Write([]byte(command))
+	if err != nil {
+		return "", fmt.Errorf("unable to send %s to wpa_supplicant, error: %v", strings.Fields(command)[0], err)
+	}
+
+	buffer := make([]byte, 16384)
+	for {
+		length, err := c.conn.Read(buffer)
+		if err != nil {
+			return "", fmt.Errorf("no answer from wpa_supplicant to %s, error: %v", strings.Fields(command)[0], err)
+		}
+
+		reply := string(buffer[:length])
+		// Unsolicited events start with <level>, they aren't the answer
+		if strings.HasPrefix(reply, "<") {
+			continue
+		}
+
+		return strings.TrimRight(reply, "\n"), nil
+	}
+}
+
+// requestOK is for the commands that only answer OK or FAIL
+func (c *WpaClient) requestOK(command string) error {
+	reply, err := c.Request(command)
+	if err != nil {
+		return err
+	}
+
+	if reply != "OK" {
+		return fmt.Errorf("wpa_supplicant rejected %s: %s", strings.Fields(command)[0], reply)
+	}
+
+	return nil
+}
+
+func parseKeyValueReply(reply string) map[string]string {
+	values := map[string]string{}
+	for _, line := range strings.Split(reply, "\n") {
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) == 2 {
+			values[parts[0]] = parts[1]
+		}
+	}
+
+	return values
+}
+
+// parseScanResults reads the tab separated SCAN_RESULTS table, the first line is the header
+func parseScanResults(reply string) []WifiScanResult {
+	results := []WifiScanResult{}
+	lines := strings.Split(reply, "\n")
+	if len(lines) < 2 {
+		return results
+	}
+
+	for _, line := range lines[1:] {
+		fields := strings.Split(line, "\t")
+		if len(fields) < 4 {
+			continue
+		}
+
+		result := WifiScanResult{BSSID: fields[0], Flags: fields[3]}
+		result.Frequency, _ = strconv.Atoi(fields[1])
+		result.Signal, _ = strconv.Atoi(fields[2])
+		if len(fields) > 4 {
+			result.SSID = fields[4]
+		}
+		results = append(results, result)
+	}
+
+	return results
+}
+
+// wpa_supplicant takes strings between plain double quotes without any escaping, the SSID is
+// sent hex encoded instead so any byte in it survives.
+func wpaQuote(value string) string {
+	return "\"" + value + "\""
+}
+
+// A 64 character hex PSK is the raw key and goes unquoted, anything else is a passphrase
+func wpaPSK(psk string) string {
+	if _, err := hex.DecodeString(psk); err == nil && len(psk) == 64 {
+		return psk
+	}
+
+	return wpaQuote(psk)
+}
+
+// Networks added by the daemon carry this prefix in their id_str, so the ones it doesn't manage
+// are left alone
+const wpaManagedTag = "core-manager:"
+
+// wpaNetworkTag is the id_str of a network the daemon added. wpa_supplicant doesn't give the
+// keys back, so a digest of the whole network tells whether it still matches the configuration.
+func wpaNetworkTag(network WifiNetwork) string {
+	digest := sha256.Sum256([]byte(fmt.Sprintf("%#v", network)))
+	return wpaManagedTag + hex.EncodeToString(digest[:8])
+}
+
+// managedNetworks gives the tag of each network the daemon added by id, including those saved
+// by an earlier run of it
+func (c *WpaClient) managedNetworks() (map[int]string, error) {
+	reply, err := c.Request("LIST_NETWORKS")
+	if err != nil {
+		return nil, err
+	}
+
+	networks := map[int]string{}
+	lines := strings.Split(reply, "\n")
+	for _, line := range lines[1:] {
+		id, err := strconv.Atoi(strings.Split(line, "\t")[0])
+		if err != nil {
+			continue
+		}
+
+		tag, err := c.Request(fmt.Sprintf("GET_NETWORK %d id_str", id))
+		if err != nil {
+			return nil, err
+		}
+		tag = strings.Trim(tag, "\"")
+		if strings.HasPrefix(tag, wpaManagedTag) {
+			networks[id] = tag
+		}
+	}
+
+	return networks, nil
+}
+
+func (c *WpaClient) addNetwork(network WifiNetwork) error {
+	reply, err := c.Request("ADD_NETWORK")
+	if err != nil {
+		return err
+	}
+
+	id, err := strconv.Atoi(reply)
+	if err != nil {
+		return fmt.Errorf("wpa_supplicant didn't create network %s: %s", network.SSID, reply)
+	}
+
+	err = c.configureNetwork(id, network)
+	if err != nil {
+		// Don't leave a half configured network behind
+		c.requestOK(fmt.Sprintf("REMOVE_NETWORK %d", id))
+		return err
+	}
+
+	return nil
+}
+
+func (c *WpaClient) configureNetwork(id int, network WifiNetwork) error {
+	settings := [][2]string{
+		{"ssid", hex.EncodeToString([]byte(network.SSID))},
+		{"priority", strconv.Itoa(network.Priority)},
+		{"id_str", wpaQuote(wpaNetworkTag(network))},
+	}
+
+	switch {
+	case network.EAP != "":
+		settings = append(settings,
+			[2]string{"key_mgmt", "WPA-EAP"},
+			[2]string{"eap", strings.ToUpper(network.EAP)},
+			[2]string{"identity", wpaQuote(network.Identity)},
+			[2]string{"password", wpaQuote(network.Password)})
+	case network.PSK != "":
+		settings = append(settings, [2]string{"key_mgmt", "WPA-PSK"}, [2]string{"psk", wpaPSK(network.PSK)})
+	default:
+		settings = append(settings, [2]string{"key_mgmt", "NONE"})
+	}
+
+	for _, setting := range settings {
+		err := c.requestOK(fmt.Sprintf("SET_NETWORK %d %s %s", id, setting[0], setting[1]))
+		if err != nil {
+			return fmt.Errorf("unable to set %s on network %s, error: %v", setting[0], network.SSID, err)
+		}
+	}
+
+	return c.requestOK(fmt.Sprintf("ENABLE_NETWORK %d", id))
+}
+
+// WifiManager keeps wpa_supplicant's network list in line with the configuration and reports
+// what the radio sees.
+type WifiManager struct {
+	appliedNetworks []WifiNetwork
+	Status          WifiStatus
+}
+
+var wifiManager WifiManager
+
+func (w *WifiManager) client() (*WpaClient, error) {
+	return dialWpaSupplicant(Config.WpaControlDir, Config.WifiInterface)
+}
+
+// ApplyNetworks brings the networks the daemon added in line with the configured ones. Only
+// those that differ are removed or added, so the network in use keeps its association, and
+// networks set up by hand stay.
+func (w *WifiManager) ApplyNetworks() error {
+	if w.appliedNetworks != nil && reflect.DeepEqual(w.appliedNetworks, Config.WifiNetworks) {
+		return nil
+	}
+
+	client, err := w.client()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	existing, err := client.managedNetworks()
+	if err != nil {
+		return err
+	}
+
+	missing := []WifiNetwork{}
+	for _, network := range Config.WifiNetworks {
+		tag := wpaNetworkTag(network)
+		found := false
+		for id, existingTag := range existing {
+			if existingTag == tag {
+				delete(existing, id)
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, network)
+		}
+	}
+
+	// What is left in existing is no longer configured, or configured differently
+	for id := range existing {
+		err = client.requestOK(fmt.Sprintf("REMOVE_NETWORK %d", id))
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, network := range missing {
+		err = client.addNetwork(network)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(existing) > 0 || len(missing) > 0 {
+		err = client.requestOK("SAVE_CONFIG")
+		if err != nil {
+			zap.S().Warnf("wpa_supplicant didn't save its configuration, networks will be reapplied after a restart, error: %v", err)
+		}
+		zap.S().Infof("wifi networks updated, %d removed and %d added", len(existing), len(missing))
+	}
+
+	w.appliedNetworks = append([]WifiNetwork{}, Config.WifiNetworks...)
+	return nil
+}
+
+// UpdateStatus reads association state, signal and the last scan, then asks for a new scan so
+// the results are fresh by the next round.
+func (w *WifiManager) UpdateStatus() error {
+	client, err := w.client()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	reply, err := client.Request("STATUS")
+	if err != nil {
+		return err
+	}
+	status := parseKeyValueReply(reply)
+
+	w.Status = WifiStatus{
+		State: status["wpa_state"],
+		SSID:  status["ssid"],
+		BSSID: status["bssid"],
+	}
+	w.Status.Frequency, _ = strconv.Atoi(status["freq"])
+
+	if w.Status.State == "COMPLETED" {
+		reply, err = client.Request("SIGNAL_POLL")
+		if err != nil {
+			return err
+		}
+		w.Status.RSSI, _ = strconv.Atoi(parseKeyValueReply(reply)["RSSI"])
+	}
+
+	reply, err = client.Request("SCAN_RESULTS")
+	if err != nil {
+		return err
+	}
+	w.Status.ScanResults = parseScanResults(reply)
+
+	// FAIL-BUSY only means a scan is already running
+	_, err = client.Request("SCAN")
+	return err
+}
+
+func (w *WifiManager) Reassociate() error {
+	client, err := w.client()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	zap.S().Infof("reassociating %s", Config.WifiInterface)
+	return client.requestOK("REASSOCIATE")
+}
+
+// Manage keeps going with no networks configured, the ones configured before still have to be
+// removed. Only without wpa_supplicant running and nothing to configure there's nothing to do.
+func (w *WifiManager) Manage() {
+	_, err := os.Stat(filepath.Join(Config.WpaControlDir, Config.WifiInterface))
+	if os.IsNotExist(err) && len(Config.WifiNetworks) == 0 {
+		w.Status = WifiStatus{}
+		return
+	}
+
+	err = w.ApplyNetworks()
+	if err != nil {
+		zap.S().Errorf("unable to apply wifi networks, error: %v", err)
+	}
+
+	err = w.UpdateStatus()
+	if err != nil {
+		zap.S().Errorf("unable to read wifi status, error: %v", err)
+	}
+}
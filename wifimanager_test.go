@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeWpaSupplicant answers the control commands ApplyNetworks uses and keeps the networks
+type fakeWpaSupplicant struct {
+	conn     *net.UnixConn
+	mutex    sync.Mutex
+	nextId   int
+	networks map[int]map[string]string
+}
+
+// startFakeWpaSupplicant points the configuration at the fake, restoring it after the test
+func startFakeWpaSupplicant(t *testing.T, interfaceName string) *fakeWpaSupplicant {
+	dir := t.TempDir()
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: filepath.Join(dir, interfaceName), Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("unable to listen on fake control socket, error: %v", err)
+	}
+
+	saved := Config
+	t.Cleanup(func() {
+		conn.Close()
+		Config = saved
+	})
+	Config.WpaControlDir = dir
+	Config.WifiInterface = interfaceName
+
+	fake := &fakeWpaSupplicant{conn: conn, networks: map[int]map[string]string{}}
+	go fake.serve()
+	return fake
+}
+
+func (f *fakeWpaSupplicant) serve() {
+	buffer := make([]byte, 4096)
+	for {
+		length, from, err := f.conn.ReadFromUnix(buffer)
+		if err != nil {
+			return
+		}
+
+		f.conn.WriteToUnix([]byte(f.handle(string(buffer[:length]))+"\n"), from)
+	}
+}
+
+func (f *fakeWpaSupplicant) handle(command string) string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	fields := strings.SplitN(command, " ", 4)
+	id := -1
+	if len(fields) > 1 {
+		id, _ = strconv.Atoi(fields[1])
+	}
+
+	switch fields[0] {
+	case "ADD_NETWORK":
+		id = f.nextId
+		f.nextId++
+		f.networks[id] = map[string]string{}
+		return strconv.Itoa(id)
+	case "LIST_NETWORKS":
+		reply := "network id / ssid / bssid / flags"
+		for _, id := range f.ids() {
+			reply += fmt.Sprintf("\n%d\t%s\tany\t", id, f.networks[id]["ssid"])
+		}
+		return reply
+	case "SET_NETWORK":
+		if f.networks[id] == nil || len(fields) < 4 {
+			return "FAIL"
+		}
+		f.networks[id][fields[2]] = fields[3]
+		return "OK"
+	case "GET_NETWORK":
+		value, ok := f.networks[id][fields[2]]
+		if !ok {
+			return "FAIL"
+		}
+		return value
+	case "REMOVE_NETWORK":
+		if f.networks[id] == nil {
+			return "FAIL"
+		}
+		delete(f.networks, id)
+		return "OK"
+	case "ENABLE_NETWORK", "SAVE_CONFIG", "SCAN":
+		return "OK"
+	case "STATUS":
+		return "wpa_state=COMPLETED\nssid=yard\nbssid=02:00:00:00:00:01\nfreq=2437"
+	case "SIGNAL_POLL":
+		return "RSSI=-61\nLINKSPEED=72"
+	case "SCAN_RESULTS":
+		return "bssid / frequency / signal level / flags / ssid\n02:00:00:00:00:01\t2437\t-61\t[WPA2-PSK-CCMP][ESS]\tyard"
+	}
+
+	return "UNKNOWN COMMAND"
+}
+
+func (f *fakeWpaSupplicant) ids() []int {
+	ids := []int{}
+	for id := range f.networks {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+func (f *fakeWpaSupplicant) network(ssid string) map[string]string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	for _, network := range f.networks {
+		if network["ssid"] == fmt.Sprintf("%x", ssid) {
+			return network
+		}
+	}
+	return nil
+}
+
+func TestApplyNetworks(t *testing.T) {
+	fake := startFakeWpaSupplicant(t, "wlan0")
+
+	// Set up by hand, the daemon must leave it alone
+	fake.networks[0] = map[string]string{"ssid": fmt.Sprintf("%x", "workshop"), "psk": "\"by hand\""}
+	fake.nextId = 1
+
+	rawPSK := strings.Repeat("0123456789abcdef", 4)
+	yard := WifiNetwork{SSID: "yard", PSK: "correct horse battery", Priority: 1}
+	Config.WifiNetworks = []WifiNetwork{{SSID: "depot", PSK: rawPSK, Priority: 2}, yard}
+
+	manager := WifiManager{}
+	err := manager.ApplyNetworks()
+	if err != nil {
+		t.Fatalf("unable to apply networks, error: %v", err)
+	}
+
+	if psk := fake.network("depot")["psk"]; psk != rawPSK {
+		t.Errorf("raw psk sent as %s, want it unquoted", psk)
+	}
+	if psk := fake.network("yard")["psk"]; psk != "\"correct horse battery\"" {
+		t.Errorf("passphrase sent as %s, want it quoted", psk)
+	}
+	if ids := fake.ids(); fmt.Sprint(ids) != "[0 1 2]" {
+		t.Errorf("networks after apply are %v, want [0 1 2]", ids)
+	}
+
+	// Dropping depot must leave yard, and with it the association, untouched
+	Config.WifiNetworks = []WifiNetwork{yard}
+	err = manager.ApplyNetworks()
+	if err != nil {
+		t.Fatalf("unable to reapply networks, error: %v", err)
+	}
+	if ids := fake.ids(); fmt.Sprint(ids) != "[0 2]" {
+		t.Errorf("networks after reapply are %v, want [0 2]", ids)
+	}
+
+	// A daemon restart forgets what it applied, its saved networks are recognised as current
+	restarted := WifiManager{}
+	err = restarted.ApplyNetworks()
+	if err != nil {
+		t.Fatalf("unable to apply networks after restart, error: %v", err)
+	}
+	if ids := fake.ids(); fmt.Sprint(ids) != "[0 2]" {
+		t.Errorf("networks after restart are %v, want [0 2]", ids)
+	}
+
+	// A changed network is replaced
+	yard.Priority = 5
+	Config.WifiNetworks = []WifiNetwork{yard}
+	err = restarted.ApplyNetworks()
+	if err != nil {
+		t.Fatalf("unable to apply changed network, error: %v", err)
+	}
+	if ids := fake.ids(); fmt.Sprint(ids) != "[0 3]" || fake.network("yard")["priority"] != "5" {
+		t.Errorf("networks after change are %v with yard %v, want [0 3] with priority 5", ids, fake.network("yard"))
+	}
+}
+
+func TestManageWithoutNetworks(t *testing.T) {
+	fake := startFakeWpaSupplicant(t, "wlan0")
+
+	Config.WifiNetworks = []WifiNetwork{{SSID: "yard", PSK: "correct horse battery"}}
+	manager := WifiManager{}
+	manager.Manage()
+
+	Config.WifiNetworks = []WifiNetwork{}
+	manager.Manage()
+
+	if ids := fake.ids(); len(ids) != 0 {
+		t.Errorf("networks left after removing them from the configuration: %v", ids)
+	}
+	if manager.Status.State != "COMPLETED" || manager.Status.RSSI != -61 || len(manager.Status.ScanResults) != 1 {
+		t.Errorf("status not reported without networks, got %+v", manager.Status)
+	}
+}
+
+func TestWpaPSK(t *testing.T) {
+	tests := []struct {
+		psk  string
+		want string
+	}{
+		{strings.Repeat("ab", 32), strings.Repeat("ab", 32)},
+		{strings.Repeat("AB", 32), strings.Repeat("AB", 32)},
+		{strings.Repeat("xy", 32), "\"" + strings.Repeat("xy", 32) + "\""},
+		{"passphrase", "\"passphrase\""},
+	}
+
+	for _, test := range tests {
+		if got := wpaPSK(test.psk); got != test.want {
+			t.Errorf("wpaPSK(%s) = %s, want %s", test.psk, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,476 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+)
+
+// WireGuard generic netlink commands and attributes from linux/wireguard.h, the x/sys version
+// we are pinned to doesn't have them
+const (
+	wgGenlName    = "wireguard"
+	wgGenlVersion = 1
+	genlHdrLen    = 4
+
+	wgCmdGetDevice = 0
+	wgCmdSetDevice = 1
+
+	wgDeviceAIfname       = 2
+	wgDeviceAPrivateKey   = 3
+	wgDeviceAFlags        = 5
+	wgDeviceAListenPort   = 6
+	wgDeviceAPeers        = 8
+	wgDeviceFReplacePeers = 1
+
+	wgPeerAPublicKey                   = 1
+	wgPeerAFlags                       = 3
+	wgPeerAEndpoint                    = 4
+	wgPeerAPersistentKeepaliveInterval = 5
+	wgPeerALastHandshakeTime           = 6
+	wgPeerARxBytes                     = 7
+	wgPeerATxBytes                     = 8
+	wgPeerAAllowedIPs                  = 9
+	wgPeerFReplaceAllowedIPs           = 2
+
+	wgAllowedIPAFamily   = 1
+	wgAllowedIPAIPAddr   = 2
+	wgAllowedIPACidrMask = 3
+)
+
+type WireGuardStatus struct {
+	Interface     string
+	Up            bool
+	Endpoint      string
+	LastHandshake time.Time
+	HandshakeAge  int // seconds, -1 before the first handshake
+	RxBytes       uint64
+	TxBytes       uint64
+	Stale         bool
+	Uplink        string // active uplink when the status was read, the tunnel rides on it
+}
+
+type netlinkAttr struct {
+	Type  uint16
+	Value []byte
+}
+
+// parseNetlinkAttributes walks a plain attribute list, generic netlink payloads have no route
+// header for syscall.ParseNetlinkRouteAttr to skip. The nested flag is dropped from the type.
+func parseNetlinkAttributes(data []byte) []netlinkAttr {
+	attributes := []netlinkAttr{}
+	for len(data) >= syscall.SizeofRtAttr {
+		length := int(*(*uint16)(unsafe.Pointer(&data[0])))
+		attributeType := *(*uint16)(unsafe.Pointer(&data[2]))
+		if length < syscall.SizeofRtAttr || length > len(data) {
+			break
+		}
+
+		attributes = append(attributes, netlinkAttr{
+			Type:  attributeType &^ unix.NLA_F_NESTED,
+			Value: data[syscall.SizeofRtAttr:length],
+		})
+
+		if netlinkAlign(length) >= len(data) {
+			break
+		}
+		data = data[netlinkAlign(length):]
+	}
+
+	return attributes
+}
+
+func nestedAttribute(attributeType uint16, attributes ...[]byte) []byte {
+	value := []byte{}
+	for _, attribute := range attributes {
+		value = append(value, attribute...)
+	}
+
+	return netlinkAttribute(attributeType|unix.NLA_F_NESTED, value)
+}
+
+func nativeUint16Bytes(value uint16) []byte {
+	bytes := make([]byte, 2)
+	*(*uint16)(unsafe.Pointer(&bytes[0])) = value
+	return bytes
+}
+
+func genlMessage(command uint8, version uint8, attributes ...[]byte) []byte {
+	payload := []byte{command, version, 0, 0}
+	for _, attribute := range attributes {
+		payload = append(payload, attribute...)
+	}
+
+	return payload
+}
+
+func genlFamilyId(name string) (uint16, error) {
+	replies, err := netlinkExecute(syscall.NETLINK_GENERIC, unix.GENL_ID_CTRL, 0,
+		genlMessage(unix.CTRL_CMD_GETFAMILY, 1,
+			netlinkAttribute(unix.CTRL_ATTR_FAMILY_NAME, append([]byte(name), 0))))
+	if err != nil {
+		return 0, fmt.Errorf("unable to resolve generic netlink family %s, error: %v", name, err)
+	}
+
+	for _, reply := range replies {
+		if len(reply.Data) < genlHdrLen {
+			continue
+		}
+		for _, attribute := range parseNetlinkAttributes(reply.Data[genlHdrLen:]) {
+			if attribute.Type == unix.CTRL_ATTR_FAMILY_ID && len(attribute.Value) >= 2 {
+				return *(*uint16)(unsafe.Pointer(&attribute.Value[0])), nil
+			}
+		}
+	}
+
+	return 0, fmt.Errorf("kernel has no %s generic netlink family", name)
+}
+
+// createWireGuardLink adds the interface if it isn't there yet, same as `ip link add type wireguard`
+func createWireGuardLink(interfaceName string) error {
+	info := syscall.IfInfomsg{Family: syscall.AF_UNSPEC}
+	payload := structBytes(unsafe.Pointer(&info), syscall.SizeofIfInfomsg)
+	payload = append(payload, netlinkAttribute(syscall.IFLA_IFNAME, append([]byte(interfaceName), 0))...)
+	payload = append(payload, nestedAttribute(unix.IFLA_LINKINFO,
+		netlinkAttribute(unix.IFLA_INFO_KIND, []byte(wgGenlName)))...)
+
+	_, err := netlinkExecute(syscall.NETLINK_ROUTE, syscall.RTM_NEWLINK,
+		syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, payload)
+	if errors.Is(err, syscall.EEXIST) {
+		return nil
+	}
+	if err != nil {
+		return linkControlError("create", interfaceName, err)
+	}
+
+	return nil
+}
+
+func decodeWireGuardKey(key string) ([]byte, error) {
+	decoded, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(decoded) != 32 {
+		return nil, fmt.Errorf("wireguard keys are 32 bytes in base64")
+	}
+
+	return decoded, nil
+}
+
+// sockaddrBytes lays out a sockaddr_in or sockaddr_in6 the way the kernel expects the endpoint
+func sockaddrBytes(address *net.UDPAddr) []byte {
+	if ip := address.IP.To4(); ip != nil {
+		sockaddr := make([]byte, 16)
+		copy(sockaddr, nativeUint16Bytes(syscall.AF_INET))
+		binary.BigEndian.PutUint16(sockaddr[2:], uint16(address.Port))
+		copy(sockaddr[4:], ip)
+		return sockaddr
+	}
+
+	sockaddr := make([]byte, 28)
+	copy(sockaddr, nativeUint16Bytes(syscall.AF_INET6))
+	binary.BigEndian.PutUint16(sockaddr[2:], uint16(address.Port))
+	copy(sockaddr[8:], address.IP.To16())
+	return sockaddr
+}
+
+func parseSockaddrBytes(sockaddr []byte) string {
+	if len(sockaddr) < 4 {
+		return ""
+	}
+
+	port := int(binary.BigEndian.Uint16(sockaddr[2:]))
+	switch *(*uint16)(unsafe.Pointer(&sockaddr[0])) {
+	case syscall.AF_INET:
+		if len(sockaddr) >= 8 {
+			return (&net.UDPAddr{IP: copyIP(sockaddr[4:8]), Port: port}).String()
+		}
+	case syscall.AF_INET6:
+		if len(sockaddr) >= 24 {
+			return (&net.UDPAddr{IP: copyIP(sockaddr[8:24]), Port: port}).String()
+		}
+	}
+
+	return ""
+}
+
+// wireGuardDeviceMessage replaces the peer list with the configured peer. Dropping the peer
+// also drops its session keys, so the next packet starts a fresh handshake.
+func wireGuardDeviceMessage(config WireGuardConfig) ([]byte, error) {
+	privateKey, err := decodeWireGuardKey(config.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key, error: %v", err)
+	}
+
+	publicKey, err := decodeWireGuardKey(config.PeerPublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid peer public key, error: %v", err)
+	}
+
+	peer := [][]byte{
+		netlinkAttribute(wgPeerAPublicKey, publicKey),
+		netlinkAttribute(wgPeerAFlags, nativeUint32Bytes(wgPeerFReplaceAllowedIPs)),
+		netlinkAttribute(wgPeerAPersistentKeepaliveInterval, nativeUint16Bytes(uint16(config.PersistentKeepalive))),
+	}
+
+	if config.PeerEndpoint != "" {
+		endpoint, err := net.ResolveUDPAddr("udp", config.PeerEndpoint)
+		if err != nil {
+			return nil, fmt.Errorf("unable to resolve peer endpoint %s, error: %v", config.PeerEndpoint, err)
+		}
+		peer = append(peer, netlinkAttribute(wgPeerAEndpoint, sockaddrBytes(endpoint)))
+	}
+
+	allowedIPs := [][]byte{}
+	for i, allowedIP := range config.AllowedIPs {
+		_, network, err := net.ParseCIDR(allowedIP)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed ip %s, error: %v", allowedIP, err)
+		}
+
+		family := uint16(syscall.AF_INET6)
+		ip := network.IP.To16()
+		if network.IP.To4() != nil {
+			family = syscall.AF_INET
+			ip = network.IP.To4()
+		}
+		ones, _ := network.Mask.Size()
+
+		allowedIPs = append(allowedIPs, nestedAttribute(uint16(i),
+			netlinkAttribute(wgAllowedIPAFamily, nativeUint16Bytes(family)),
+			netlinkAttribute(wgAllowedIPAIPAddr, ip),
+			netlinkAttribute(wgAllowedIPACidrMask, []byte{uint8(ones)})))
+	}
+	peer = append(peer, nestedAttribute(wgPeerAAllowedIPs, allowedIPs...))
+
+	return genlMessage(wgCmdSetDevice, wgGenlVersion,
+		netlinkAttribute(wgDeviceAIfname, append([]byte(config.Interface), 0)),
+		netlinkAttribute(wgDeviceAPrivateKey, privateKey),
+		netlinkAttribute(wgDeviceAListenPort, nativeUint16Bytes(uint16(config.ListenPort))),
+		netlinkAttribute(wgDeviceAFlags, nativeUint32Bytes(wgDeviceFReplacePeers)),
+		nestedAttribute(wgDeviceAPeers, nestedAttribute(0, peer...))), nil
+}
+
+func readWireGuardPeer(family uint16, interfaceName string) (WireGuardStatus, error) {
+	status := WireGuardStatus{Interface: interfaceName, HandshakeAge: -1}
+
+	replies, err := netlinkExecute(syscall.NETLINK_GENERIC, family, syscall.NLM_F_DUMP,
+		genlMessage(wgCmdGetDevice, wgGenlVersion,
+			netlinkAttribute(wgDeviceAIfname, append([]byte(interfaceName), 0))))
+	if err != nil {
+		return status, err
+	}
+
+	for _, reply := range replies {
+		if len(reply.Data) < genlHdrLen {
+			continue
+		}
+
+		for _, deviceAttribute := range parseNetlinkAttributes(reply.Data[genlHdrLen:]) {
+			if deviceAttribute.Type != wgDeviceAPeers {
+				continue
+			}
+
+			for _, peer := range parseNetlinkAttributes(deviceAttribute.Value) {
+				for _, attribute := range parseNetlinkAttributes(peer.Value) {
+					switch attribute.Type {
+					case wgPeerAEndpoint:
+						status.Endpoint = parseSockaddrBytes(attribute.Value)
+					case wgPeerALastHandshakeTime:
+						// struct __kernel_timespec, zero until the first handshake
+						if len(attribute.Value) >= 16 {
+							seconds := *(*int64)(unsafe.Pointer(&attribute.Value[0]))
+							nanoseconds := *(*int64)(unsafe.Pointer(&attribute.Value[8]))
+							if seconds != 0 || nanoseconds != 0 {
+								status.LastHandshake = time.Unix(seconds, nanoseconds)
+							}
+						}
+					case wgPeerARxBytes:
+						if len(attribute.Value) >= 8 {
+							status.RxBytes = *(*uint64)(unsafe.Pointer(&attribute.Value[0]))
+						}
+					case wgPeerATxBytes:
+						if len(attribute.Value) >= 8 {
+							status.TxBytes = *(*uint64)(unsafe.Pointer(&attribute.Value[0]))
+						}
+					}
+				}
+			}
+		}
+	}
+
+	if !status.LastHandshake.IsZero() {
+		status.HandshakeAge = int(time.Since(status.LastHandshake).Seconds())
+	}
+
+	return status, nil
+}
+
+// WireGuardManager owns the management tunnel. The interface doesn't depend on the modem so it
+// stays up through cellular resets, only the peer is re-applied to get a handshake going again.
+type WireGuardManager struct {
+	mutex         sync.Mutex
+	family        uint16
+	appliedConfig *WireGuardConfig
+	appliedAt     time.Time
+	status        WireGuardStatus
+}
+
+var wireGuard WireGuardManager
+
+func (w *WireGuardManager) Status() WireGuardStatus {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.status
+}
+
+func (w *WireGuardManager) apply(config WireGuardConfig) error {
+	if w.family == 0 {
+		family, err := genlFamilyId(wgGenlName)
+		if err != nil {
+			return err
+		}
+		w.family = family
+	}
+
+	err := createWireGuardLink(config.Interface)
+	if err != nil {
+		return err
+	}
+
+	message, err := wireGuardDeviceMessage(config)
+	if err != nil {
+		return err
+	}
+
+	_, err = netlinkExecute(syscall.NETLINK_GENERIC, w.family, 0, message)
+	if err != nil {
+		return linkControlError("configure wireguard on", config.Interface, err)
+	}
+
+	if config.Address != "" {
+		ip, network, err := net.ParseCIDR(config.Address)
+		if err != nil {
+			return fmt.Errorf("invalid wireguard address %s, error: %v", config.Address, err)
+		}
+		err = addAddress(config.Interface, net.IPNet{IP: ip, Mask: network.Mask})
+		if err != nil {
+			return err
+		}
+	}
+
+	err = setLinkUp(config.Interface)
+	if err != nil {
+		return err
+	}
+
+	state, err := getInterfaceState(config.Interface)
+	if err != nil {
+		return err
+	}
+
+	for _, allowedIP := range config.AllowedIPs {
+		// The tunnel is for reaching the device, it must never take over the default route
+		_, network, _ := net.ParseCIDR(allowedIP)
+		if ones, _ := network.Mask.Size(); ones == 0 {
+			continue
+		}
+		err = replaceRoute(InterfaceRoute{Destination: *network}, state.Index)
+		if err != nil {
+			return linkControlError("route allowed ips through", config.Interface, err)
+		}
+	}
+
+	applied := config
+	applied.AllowedIPs = append([]string{}, config.AllowedIPs...)
+	w.appliedConfig = &applied
+	w.appliedAt = time.Now()
+	return nil
+}
+
+// Rehandshake is called once a data session is back. The peer endpoint is resolved again and
+// the old session thrown away, so the peer learns our new address right away instead of after
+// the next rekey.
+func (w *WireGuardManager) Rehandshake() {
+	if !Config.WireGuard.Enabled {
+		return
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	err := w.apply(Config.WireGuard)
+	if err != nil {
+		zap.S().Errorf("unable to restart wireguard handshake, error: %v", err)
+		return
+	}
+
+	zap.S().Infof("restarted wireguard handshake on %s", Config.WireGuard.Interface)
+}
+
+// Manage applies configuration changes and reads the handshake age. A tunnel that never
+// completed a handshake gets StaleHandshake seconds after it was set up before it counts as stale.
+func (w *WireGuardManager) Manage(uplink string) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if !Config.WireGuard.Enabled {
+		w.status = WireGuardStatus{}
+		return
+	}
+
+	if w.appliedConfig == nil || !reflect.DeepEqual(*w.appliedConfig, Config.WireGuard) {
+		err := w.apply(Config.WireGuard)
+		if err != nil {
+			zap.S().Errorf("unable to set up wireguard, error: %v", err)
+			w.status = WireGuardStatus{Interface: Config.WireGuard.Interface, HandshakeAge: -1, Stale: true, Uplink: uplink}
+			return
+		}
+		zap.S().Infof("wireguard tunnel %s configured", Config.WireGuard.Interface)
+	}
+
+	status, err := readWireGuardPeer(w.family, Config.WireGuard.Interface)
+	if err != nil {
+		zap.S().Errorf("unable to read wireguard status, error: %v", err)
+	}
+
+	state, err := getInterfaceState(Config.WireGuard.Interface)
+	status.Up = err == nil && state.Up
+
+	staleAfter := time.Duration(Config.WireGuard.StaleHandshake) * time.Second
+	if status.LastHandshake.IsZero() {
+		status.Stale = time.Since(w.appliedAt) > staleAfter
+	} else {
+		status.Stale = time.Since(status.LastHandshake) > staleAfter
+	}
+	if status.Stale && !w.status.Stale {
+		zap.S().Warnf("wireguard tunnel %s is stale, last handshake %d seconds ago",
+			Config.WireGuard.Interface, status.HandshakeAge)
+	}
+
+	status.Uplink = uplink
+	w.status = status
+}
+
+// HealthError reports a stale tunnel as lost connectivity on the uplink carrying it, when
+// configured to
+func (w *WireGuardManager) HealthError(interfaceName string) error {
+	if !Config.WireGuard.Enabled || !Config.WireGuard.StaleIsFailure {
+		return nil
+	}
+
+	status := w.Status()
+	if !status.Stale || (status.Uplink != "" && status.Uplink != interfaceName) {
+		return nil
+	}
+
+	return fmt.Errorf("wireguard tunnel %s has no recent handshake", status.Interface)
+}